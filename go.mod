@@ -1,15 +1,24 @@
 module github.com/md-irohas/rcap-go
 
-go 1.14
+go 1.22
 
 require (
 	github.com/go-playground/validator/v10 v10.14.1
 	github.com/google/go-cmp v0.5.7
 	github.com/google/gopacket v1.1.19
 	github.com/jehiah/go-strftime v0.0.0-20171201141054-1d33003b3869
-	github.com/kr/pretty v0.3.0 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/pelletier/go-toml v1.9.5
-	github.com/rogpeppe/go-internal v1.8.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21
+)
+
+require (
+	github.com/gabriel-vasile/mimetype v1.4.2 // indirect
+	github.com/go-playground/locales v0.14.1 // indirect
+	github.com/go-playground/universal-translator v0.18.1 // indirect
+	github.com/leodido/go-urn v1.2.4 // indirect
+	golang.org/x/crypto v0.10.0 // indirect
 	golang.org/x/net v0.11.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.10.0 // indirect
 )
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/md-irohas/rcap-go/rcap"
 )
@@ -13,6 +15,24 @@ var (
 	Version = "(unset)" // Version
 )
 
+// stringsFlag is a flag which can be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
 	var configFile string
 	var showVersion bool
@@ -28,19 +48,64 @@ func main() {
 	r := &argsConfig.Rcap
 
 	// rcap config flags.
-	flag.StringVar(&r.Device, "i", "any", "device name (e.g. en0, eth0).")
+	flag.StringVar(&r.Device, "i", "any", "device name (e.g. en0, eth0). multiple devices are separated by comma (e.g. eth0,eth1).")
+	flag.Var((*stringsFlag)(&r.ReadFiles), "r", "read packets from pcap files instead of devices (e.g. 'dump/*.pcap'). can be given multiple times.")
 	flag.UintVar(&r.SnapLen, "s", 65535, "snapshot length.")
 	flag.BoolVar(&r.Promisc, "p", true, "do NOT put into promiscuous mode.")
 	flag.UintVar(&r.ToMs, "t", 100, "timeout of reading packets from interface [milli-sec].")
 	flag.StringVar(&r.BpfRules, "f", "", "BPF rules.")
+	flag.IntVar(&r.BufferSize, "buffer", 0, "kernel buffer size of capture [byte]. 0 means the default of libpcap.")
+	flag.BoolVar(&r.ImmediateMode, "immediate", false, "deliver packets as soon as they arrive (immediate mode).")
+	flag.StringVar(&r.TimestampPrecision, "tsprecision", "micro", "precision of timestamps of capture and output file (micro or nano).")
+	flag.StringVar(&r.TimestampType, "tstype", "", "timestamp type (e.g. host, adapter). empty means the default of libpcap.")
+	flag.UintVar(&r.QueueSize, "queuesize", 8192, "number of captured packets queued for writing.")
+	flag.StringVar(&r.QueuePolicy, "queuepolicy", "block", "policy if the queue is full (block or drop).")
 	flag.StringVar(&r.FileFmt, "w", "dump/%Y%m%d/traffic-%Y%m%d%H%M%S.pcap", "format of output file.")
 	flag.BoolVar(&r.FileAppend, "append", true, "append data to a file if it exists. to disable, add -append=false as argument.")
+	flag.StringVar(&r.AppendMismatch, "appendmismatch", "suffix", "policy if the header of the existing file does not match (suffix or fail).")
+	flag.StringVar(&r.OutputFormat, "F", "pcap", "format of output file (pcap or pcapng).")
+	flag.StringVar(&r.Compression, "compress", "none", "compression of output file (none, gzip, zstd or lz4).")
+	flag.StringVar(&r.CompressionMode, "compressmode", "stream", "compress output file while writing (stream) or after rotation (rotate).")
+	flag.StringVar(&r.PartFiles, "part", "none", "write output file under a temporary name until it is closed (none, suffix or dot).")
+	flag.StringVar(&r.PartSuffix, "partsuffix", ".part", "suffix of output file in progress if -part is suffix.")
+	flag.IntVar(&r.WriteBufferSize, "writebuffer", 65536, "buffer size of output file [byte]. 0 disables the buffer.")
+	flag.DurationVar(&r.FlushInterval, "flush", time.Second, "interval to flush the buffer of output file (e.g. 1s). 0 flushes it only at rotation.")
+	flag.StringVar(&r.FsyncPolicy, "fsync", "never", "when output file is synced to the disk (never, rotate or interval).")
+	flag.DurationVar(&r.FsyncInterval, "fsyncinterval", 10*time.Second, "interval to sync output file if -fsync is interval (e.g. 10s).")
+	flag.Int64Var(&r.MaxFileBytes, "filebytes", 0, "rotate output file when its size (before compression) exceeds this [byte] within the interval. 0 means no limit.")
+	flag.UintVar(&r.RingFiles, "W", 0, "number of output files of the ring buffer. the oldest file is overwritten at rotation. -w must not contain date and time formats. 0 disables it.")
+	flag.UintVar(&r.MaxFilePackets, "filepackets", 0, "rotate output file when the number of its packets exceeds this within the interval. 0 means no limit.")
+	flag.Float64Var(&r.DropWarnRatio, "dropwarn", 0.01, "warn when the ratio of packets dropped by kernel exceeds this at rotation (0.0 <= p <= 1.0). 0 disables the warning.")
+	flag.StringVar(&r.MetricsAddr, "metrics", "", "address of HTTP endpoint to expose metrics on /metrics (e.g. :9100). disabled if empty.")
+	flag.DurationVar(&r.RetentionMaxAge, "maxage", 0, "remove output files older than this (e.g. 720h). 0 means no limit.")
+	flag.Int64Var(&r.RetentionMaxBytes, "maxbytes", 0, "remove the oldest output files while their total size exceeds this [byte]. 0 means no limit.")
+	flag.UintVar(&r.RetentionMaxFiles, "maxfiles", 0, "remove the oldest output files while their number exceeds this. 0 means no limit.")
+	flag.Uint64Var(&r.RetentionMinFreeBytes, "minfree", 0, "remove the oldest output files while the free disk space is less than this [byte]. 0 means no limit.")
+	flag.BoolVar(&r.Manifest, "manifest", false, "write a JSON manifest (timestamps, counts, SHA-256, devices, ...) next to each output file when it is closed.")
+	flag.StringVar(&r.ManifestIndex, "manifestindex", "", "JSON Lines file listing the manifests of all output files. disabled if empty.")
+	flag.StringVar(&r.HookCommand, "hook", "", "command executed after each output file is closed. {file}, {start}, {end}, {packets} and {bytes} are replaced (e.g. 'gzip {file}'). disabled if empty.")
+	flag.DurationVar(&r.HookTimeout, "hooktimeout", time.Minute, "timeout of the hook command. 0 means no timeout.")
+	flag.UintVar(&r.HookConcurrency, "hookconcurrency", 1, "max number of hook commands running at once.")
+	flag.BoolVar(&r.Trigger, "trigger", false, "write packets only around triggers (BPF match of -triggerfilter, SIGUSR2 or POST /trigger of -triggeraddr).")
+	flag.StringVar(&r.TriggerAddr, "triggeraddr", "", "address of HTTP endpoint to fire the trigger on POST /trigger (e.g. 127.0.0.1:9101). it has no authentication. disabled if empty.")
+	flag.StringVar(&r.TriggerFilter, "triggerfilter", "", "BPF rules of packets which fire the trigger. disabled if empty.")
+	flag.DurationVar(&r.TriggerPre, "triggerpre", 10*time.Second, "duration of packets kept in memory before the trigger.")
+	flag.Int64Var(&r.TriggerPreBytes, "triggerprebytes", 64*1024*1024, "max bytes of packets kept in memory before the trigger. 0 means no limit.")
+	flag.DurationVar(&r.TriggerPost, "triggerpost", 10*time.Second, "duration of packets written after the trigger.")
+	flag.StringVar(&r.AnonymizeKey, "anonkey", "", "hex-encoded 32-byte key to anonymize IP addresses by Crypto-PAn. disabled if empty.")
 	flag.StringVar(&r.Timezone, "z", "UTC", "timezone used for output file.")
 	flag.Int64Var(&r.Interval, "T", 60, "rotation interval [sec]. to disable rotation, set 0.")
 	flag.Int64Var(&r.Offset, "offset", 0, "[deprecated] rotation interval offset [sec]. use -utcoffset instead.")
 	flag.DurationVar(&r.UTCOffset, "utcoffset", 0, "rotation interval offset from UTC. The negative value is also available. see https://pkg.go.dev/time#Duration for the format.")
 	flag.Float64Var(&r.Sampling, "sampling", 1.0, "sampling rate (0.0 <= p <= 1.0).")
-	flag.StringVar(&r.LogFile, "L", "", "[deprecated] log file.")
+	flag.Float64Var(&r.RateLimitPackets, "ratepackets", 0, "max packets per second written to files. 0 means no limit.")
+	flag.Float64Var(&r.RateLimitBytes, "ratebytes", 0, "max bytes per second written to files. 0 means no limit.")
+	flag.BoolVar(&r.RateLimitPerSource, "ratepersource", false, "apply -ratepackets and -ratebytes per source IP address.")
+	flag.StringVar(&r.SamplingStrategy, "samplingstrategy", "random", "strategy of sampling (random, flow or nth).")
+	flag.Int64Var(&r.SamplingSeed, "samplingseed", 0, "seed of sampling. 0 means the current time for random sampling.")
+	flag.StringVar(&r.LogFile, "L", "", "log file (stderr if empty). the file is reopened on SIGHUP or SIGUSR1.")
+	flag.StringVar(&r.LogFormat, "logformat", "text", "format of logs (text or json).")
+	flag.StringVar(&r.LogLevel, "loglevel", "info", "minimum level of logs (debug, info, warn or error).")
 	flag.BoolVar(&r.UseSystemTime, "S", false, "use system time as a time source of rotation (default: use packet-captured time).")
 	flag.Parse()
 
@@ -49,33 +114,40 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.Printf("rcap version: %v", Version)
+	slog.Info("rcap version", "version", Version)
+
+	// The version is written to manifests.
+	rcap.Version = Version
 
 	if configFile != "" {
-		log.Printf("load config: %v", configFile)
+		slog.Info("load config", "file", configFile)
 
 		// Load config from file and check its parameters.
 		fileConfig, err = rcap.LoadConfig(configFile)
 		if err != nil {
-			log.Fatalf("failed to load config from file: %v", err)
+			fatal("failed to load config from file", err)
 		}
 
 		config = fileConfig
 	} else {
-		log.Println("load config from command-line.")
+		slog.Info("load config from command-line.")
 
 		// Check config parsed from command-line.
 		err = argsConfig.CheckAndFormat()
 		if err != nil {
-			log.Fatalf("failed to load config from command-line: %v", err)
+			fatal("failed to load config from command-line", err)
 		}
 
 		config = argsConfig
 	}
 
+	if err := rcap.SetupLogger(&config.Rcap); err != nil {
+		fatal("failed to set up logger", err)
+	}
+
 	config.PrintToLog()
 
 	if err := rcap.Run(config); err != nil {
-		log.Fatalf("fatal error: %v", err)
+		fatal("fatal error", err)
 	}
 }
@@ -0,0 +1,258 @@
+package rcap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// AnonymizeKeyLen is the length of the key of prefix-preserving
+	// anonymization in bytes (hex-encoded in the config).
+	AnonymizeKeyLen = 32
+
+	// anonymizeCacheSize is the max number of cached addresses. The cache is
+	// cleared when it is full.
+	anonymizeCacheSize = 65536
+)
+
+// cryptoPAn is the prefix-preserving anonymization of IP addresses by
+// Crypto-PAn (Xu et al.). Addresses sharing a prefix of k bits are mapped to
+// addresses sharing a prefix of k bits.
+type cryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// newCryptoPAn returns a new instance of cryptoPAn. The first 16 bytes of the
+// key are the AES key, and the rest are encrypted to make the pad.
+func newCryptoPAn(key []byte) (*cryptoPAn, error) {
+	if len(key) != AnonymizeKeyLen {
+		return nil, fmt.Errorf("invalid key length: %v bytes (must be %v bytes)", len(key), AnonymizeKeyLen)
+	}
+
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// Anonymize returns the anonymized address of the IPv4 (4 bytes) or IPv6 (16
+// bytes) address.
+func (c *cryptoPAn) Anonymize(addr []byte) []byte {
+	numBits := len(addr) * 8
+	result := make([]byte, len(addr))
+
+	var input, output [aes.BlockSize]byte
+
+	for pos := 0; pos < numBits; pos++ {
+		// The input is the first pos bits of the address followed by the
+		// bits of the pad.
+		copy(input[:], c.pad[:])
+		for i := 0; i < pos/8; i++ {
+			input[i] = addr[i]
+		}
+		if rem := pos % 8; rem > 0 {
+			mask := byte(0xff << (8 - rem))
+			input[pos/8] = (addr[pos/8] & mask) | (c.pad[pos/8] & ^mask)
+		}
+
+		c.block.Encrypt(output[:], input[:])
+
+		// The first bit of the output flips the bit of the address.
+		result[pos/8] |= (output[0] >> 7) << (7 - pos%8)
+	}
+
+	for i := range result {
+		result[i] ^= addr[i]
+	}
+	return result
+}
+
+// anonymizer rewrites IP addresses of packets by the fixed mapping or the
+// prefix-preserving anonymization, and updates checksums of IP, TCP, UDP and
+// ICMPv6 headers.
+type anonymizer struct {
+	cryptoPAn *cryptoPAn        // nil if only the fixed mapping is used.
+	mapping   map[string]net.IP // Fixed mapping of addresses (16-byte form).
+	cache     map[string][]byte
+}
+
+// newAnonymizer returns a new instance of anonymizer, or nil if anonymization
+// is not configured.
+func newAnonymizer(c *RcapConfig) (*anonymizer, error) {
+	if c.AnonymizeKey == "" && len(c.AnonymizeAddrs) == 0 {
+		return nil, nil
+	}
+
+	a := &anonymizer{
+		mapping: make(map[string]net.IP),
+		cache:   make(map[string][]byte),
+	}
+
+	if c.AnonymizeKey != "" {
+		key, err := hex.DecodeString(c.AnonymizeKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid anonymize key: %w", err)
+		}
+		if a.cryptoPAn, err = newCryptoPAn(key); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range c.AnonymizeAddrs {
+		from, to := net.ParseIP(m.From), net.ParseIP(m.To)
+		if from == nil || to == nil || (from.To4() == nil) != (to.To4() == nil) {
+			return nil, fmt.Errorf("invalid address mapping: %v -> %v", m.From, m.To)
+		}
+		a.mapping[string(from.To16())] = to.To16()
+	}
+
+	return a, nil
+}
+
+// anonymizeAddr returns the anonymized address. Addresses not in the mapping
+// are returned as they are if prefix-preserving anonymization is disabled.
+func (a *anonymizer) anonymizeAddr(addr []byte) []byte {
+	key := string(net.IP(addr).To16())
+	if to, ok := a.mapping[key]; ok {
+		if len(addr) == net.IPv4len {
+			return to.To4()
+		}
+		return to
+	}
+
+	if a.cryptoPAn == nil {
+		return addr
+	}
+
+	// IPv4 addresses and IPv4-mapped IPv6 addresses are cached separately.
+	key = string(addr)
+	if result, ok := a.cache[key]; ok {
+		return result
+	}
+	if len(a.cache) >= anonymizeCacheSize {
+		a.cache = make(map[string][]byte)
+	}
+
+	result := a.cryptoPAn.Anonymize(addr)
+	a.cache[key] = result
+	return result
+}
+
+// updateChecksum returns the checksum updated for the data changed from
+// before to after (RFC 1624). The lengths of them must be the same and even.
+func updateChecksum(checksum uint16, before, after []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(before); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(before[i:]))
+		sum += uint32(binary.BigEndian.Uint16(after[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// rewriteField replaces the address at the offset of data with the anonymized
+// one and updates the checksums at the offsets (if captured).
+func (a *anonymizer) rewriteField(data []byte, offset int, length int, checksums []int) {
+	if offset+length > len(data) {
+		return
+	}
+
+	addr := make([]byte, length)
+	copy(addr, data[offset:offset+length])
+	anonymized := a.anonymizeAddr(addr)
+	copy(data[offset:], anonymized)
+
+	for _, pos := range checksums {
+		if pos+2 > len(data) {
+			continue
+		}
+		checksum := binary.BigEndian.Uint16(data[pos:])
+		binary.BigEndian.PutUint16(data[pos:], updateChecksum(checksum, addr, anonymized))
+	}
+}
+
+// transportChecksumOffset returns the offset of the checksum in the layer
+// which covers the pseudo-header (TCP, UDP or ICMPv6), or -1.
+func transportChecksumOffset(layer gopacket.Layer) int {
+	switch l := layer.(type) {
+	case *layers.TCP:
+		return 16
+	case *layers.UDP:
+		// No checksum in UDP over IPv4.
+		if l.Checksum == 0 {
+			return -1
+		}
+		return 6
+	case *layers.ICMPv6:
+		return 2
+	}
+	return -1
+}
+
+// Anonymize returns a copy of the packet with anonymized IP addresses. The
+// checksums are updated incrementally, so they are correct even if the packet
+// is truncated (as long as the original checksums are correct). Addresses
+// inside payloads (e.g. ICMP errors) are not anonymized.
+func (a *anonymizer) Anonymize(data []byte, linkType layers.LinkType) []byte {
+	p := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	result := make([]byte, len(data))
+	copy(result, data)
+
+	// Offsets of the address fields of the last IP layer, which are covered
+	// by the checksum of the transport layer.
+	type addrField struct{ offset, length int }
+	var fields []addrField
+
+	offset := 0
+	for _, layer := range p.Layers() {
+		switch layer.(type) {
+		case *layers.IPv4:
+			fields = []addrField{{offset + 12, net.IPv4len}, {offset + 16, net.IPv4len}}
+			for _, f := range fields {
+				a.rewriteField(result, f.offset, f.length, []int{offset + 10})
+			}
+		case *layers.IPv6:
+			fields = []addrField{{offset + 8, net.IPv6len}, {offset + 24, net.IPv6len}}
+			for _, f := range fields {
+				a.rewriteField(result, f.offset, f.length, nil)
+			}
+		default:
+			if pos := transportChecksumOffset(layer); pos >= 0 && fields != nil {
+				// The addresses are already rewritten, so the checksum is
+				// updated from the original addresses in data.
+				pos += offset
+				for _, f := range fields {
+					if pos+2 > len(result) || f.offset+f.length > len(result) {
+						continue
+					}
+					checksum := binary.BigEndian.Uint16(result[pos:])
+					checksum = updateChecksum(checksum, data[f.offset:f.offset+f.length], result[f.offset:f.offset+f.length])
+					if _, ok := layer.(*layers.UDP); ok && checksum == 0 {
+						// 0 means no checksum in UDP.
+						checksum = 0xffff
+					}
+					binary.BigEndian.PutUint16(result[pos:], checksum)
+				}
+			}
+		}
+
+		offset += len(layer.LayerContents())
+	}
+
+	return result
+}
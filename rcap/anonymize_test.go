@@ -0,0 +1,156 @@
+package rcap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The key and addresses are the sample of the reference implementation of
+// Crypto-PAn.
+var cryptoPAnSampleKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+func TestCryptoPAnAnonymize(t *testing.T) {
+	c, err := newCryptoPAn(cryptoPAnSampleKey)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	cases := []struct {
+		addr     string
+		expected string
+	}{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+		{"152.163.225.39", "151.140.114.167"},
+		{"156.29.3.236", "147.225.12.42"},
+		{"165.247.96.84", "162.9.99.234"},
+		{"166.107.77.190", "160.132.178.185"},
+		{"192.102.249.13", "252.138.62.131"},
+	}
+
+	for _, c2 := range cases {
+		got := net.IP(c.Anonymize(net.ParseIP(c2.addr).To4())).String()
+		if got != c2.expected {
+			t.Errorf("'%v' is expected, but got '%v' (%v).", c2.expected, got, c2.addr)
+		}
+	}
+
+	// Prefixes are preserved for IPv6.
+	a := c.Anonymize(net.ParseIP("2001:db8::1"))
+	b := c.Anonymize(net.ParseIP("2001:db8::2"))
+	if len(a) != net.IPv6len || net.IP(a).Mask(net.CIDRMask(126, 128)).String() != net.IP(b).Mask(net.CIDRMask(126, 128)).String() {
+		t.Errorf("the same /126 prefix is expected, but got '%v' and '%v'.", net.IP(a), net.IP(b))
+	}
+
+	if _, err := newCryptoPAn([]byte("short")); err == nil {
+		t.Errorf("error is expected, but got nil.")
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	before := []byte{192, 0, 2, 1}
+	after := []byte{10, 0, 0, 1}
+
+	// The checksum of 0x4500 followed by the address.
+	checksum := func(addr []byte) uint16 {
+		sum := uint32(0x4500)
+		sum += uint32(addr[0])<<8 | uint32(addr[1])
+		sum += uint32(addr[2])<<8 | uint32(addr[3])
+		for sum > 0xffff {
+			sum = (sum >> 16) + (sum & 0xffff)
+		}
+		return ^uint16(sum)
+	}
+
+	if got, expected := updateChecksum(checksum(before), before, after), checksum(after); got != expected {
+		t.Errorf("'%x' is expected, but got '%x'.", expected, got)
+	}
+}
+
+// verifyChecksums decodes the packet again and checks the checksums by
+// serializing the layers with ComputeChecksums.
+func verifyChecksums(t *testing.T, data []byte) {
+	p := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	var serializable []gopacket.SerializableLayer
+	for _, layer := range p.Layers() {
+		switch l := layer.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		}
+		serializable = append(serializable, layer.(gopacket.SerializableLayer))
+
+		// The payload of the transport layer is serialized as it is.
+		if layer == p.TransportLayer() {
+			serializable = append(serializable, gopacket.Payload(layer.LayerPayload()))
+			break
+		}
+	}
+	if err := gopacket.SerializeLayers(buf, opts, serializable...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+
+	if string(buf.Bytes()) != string(data) {
+		t.Errorf("valid checksums are expected, but got '%x' (expected '%x').", data, buf.Bytes())
+	}
+}
+
+func TestAnonymizerAnonymize(t *testing.T) {
+	c := makeConfig()
+	if a, err := newAnonymizer(&c.Rcap); a != nil || err != nil {
+		t.Errorf("nil is expected, but got '%v' (%v).", a, err)
+	}
+
+	c.Rcap.AnonymizeKey = "1522178d33a4cf80130a5b1649907d10d8988f837979652762574c2d2a842202"
+	c.Rcap.AnonymizeAddrs = []AddrMapping{{From: "192.0.2.1", To: "10.0.0.1"}}
+	a, err := newAnonymizer(&c.Rcap)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	tcp := makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80)
+	udp := makeUDPPacket(t, 12345, 53, []byte("data"))
+
+	for _, data := range [][]byte{tcp, udp} {
+		orig := string(data)
+		got := a.Anonymize(data, layers.LinkTypeEthernet)
+
+		if string(data) != orig {
+			t.Errorf("the original data are expected not to be changed.")
+		}
+		verifyChecksums(t, got)
+
+		p := gopacket.NewPacket(got, layers.LinkTypeEthernet, gopacket.Default)
+		ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if ip.SrcIP.String() != "10.0.0.1" {
+			t.Errorf("'10.0.0.1' is expected, but got '%v'.", ip.SrcIP)
+		}
+		if ip.DstIP.String() == "198.51.100.1" {
+			t.Errorf("an anonymized address is expected, but got '%v'.", ip.DstIP)
+		}
+	}
+
+	// Invalid configs.
+	c.Rcap.AnonymizeAddrs = []AddrMapping{{From: "192.0.2.1", To: "2001:db8::1"}}
+	if _, err := newAnonymizer(&c.Rcap); err == nil {
+		t.Errorf("error is expected, but got nil.")
+	}
+	c.Rcap.AnonymizeAddrs = nil
+	c.Rcap.AnonymizeKey = "00"
+	if _, err := newAnonymizer(&c.Rcap); err == nil {
+		t.Errorf("error is expected, but got nil.")
+	}
+}
@@ -0,0 +1,244 @@
+package rcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// AppendMismatchSuffix appends packets to the file with the next suffix
+	// (e.g. some-file-1.pcap) if the existing file does not match.
+	AppendMismatchSuffix = "suffix"
+	// AppendMismatchFail returns an error if the existing file does not match.
+	AppendMismatchFail = "fail"
+
+	pcapFileHeaderLen   = 24
+	pcapRecordHeaderLen = 16
+
+	pcapNgBlockTypeSHB   = 0x0A0D0D0A
+	pcapNgByteOrderMagic = 0x1A2B3C4D
+)
+
+// errHeaderMismatch means that the header of the existing file does not match
+// the Writer.
+var errHeaderMismatch = errors.New("file header mismatch")
+
+// pcapFileHeader is the file header of a pcap file.
+type pcapFileHeader struct {
+	byteOrder binary.ByteOrder
+	nanos     bool
+	snapLen   uint32
+	linkType  layers.LinkType
+}
+
+// readPcapFileHeader reads the file header of a pcap file.
+func readPcapFileHeader(r io.Reader) (*pcapFileHeader, error) {
+	var buf [pcapFileHeaderLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	header := &pcapFileHeader{}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(buf[0:4]) {
+		case pcapMagicMicros:
+			header.byteOrder = order
+		case pcapMagicNanos:
+			header.byteOrder = order
+			header.nanos = true
+		}
+		if header.byteOrder != nil {
+			break
+		}
+	}
+
+	if header.byteOrder == nil {
+		return nil, fmt.Errorf("unknown magic number: 0x%x", buf[0:4])
+	}
+
+	header.snapLen = header.byteOrder.Uint32(buf[16:20])
+	header.linkType = layers.LinkType(header.byteOrder.Uint32(buf[20:24]))
+
+	return header, nil
+}
+
+// pcapHeaderParams returns the snaplen and linktype written to the header of
+// a pcap file for the interfaces (see newPcapWriter).
+func pcapHeaderParams(interfaces []captureInterface) (uint32, layers.LinkType) {
+	snapLen := interfaces[0].device.SnapLen
+	for _, intf := range interfaces[1:] {
+		if intf.device.SnapLen > snapLen {
+			snapLen = intf.device.SnapLen
+		}
+	}
+	return uint32(snapLen), interfaces[0].linkType
+}
+
+// validatePcapFileHeader returns errHeaderMismatch if packets captured on the
+// interfaces cannot be appended to a pcap file with the header.
+func validatePcapFileHeader(header *pcapFileHeader, nanos bool, interfaces []captureInterface) error {
+	snapLen, linkType := pcapHeaderParams(interfaces)
+
+	switch {
+	case header.byteOrder != binary.LittleEndian:
+		// pcapgo.Writer writes records in little endian.
+		return fmt.Errorf("%w: byte order is %v", errHeaderMismatch, header.byteOrder)
+	case header.nanos != nanos:
+		return fmt.Errorf("%w: nanos is %v, not %v", errHeaderMismatch, header.nanos, nanos)
+	case header.snapLen != snapLen:
+		return fmt.Errorf("%w: snaplen is %v, not %v", errHeaderMismatch, header.snapLen, snapLen)
+	case header.linkType != linkType:
+		return fmt.Errorf("%w: linktype is %v, not %v", errHeaderMismatch, header.linkType, linkType)
+	}
+
+	return nil
+}
+
+// completeLength returns the length of the complete part of the file. The
+// rest (if any) is a record or block partially written (e.g. by a crash).
+func completeLength(r io.Reader, format string, header *pcapFileHeader) (int64, error) {
+	br := bufio.NewReader(r)
+
+	var buf [pcapRecordHeaderLen]byte
+	var length int64
+
+	if format == FormatPcapNg {
+		// Blocks: type (4 bytes), total length (4 bytes), body and total length.
+		var order binary.ByteOrder = binary.LittleEndian
+		for {
+			if _, err := io.ReadFull(br, buf[:12]); err != nil {
+				return length, nil
+			}
+
+			if binary.LittleEndian.Uint32(buf[0:4]) == pcapNgBlockTypeSHB {
+				// Each section has its own byte order.
+				order = binary.LittleEndian
+				if binary.BigEndian.Uint32(buf[8:12]) == pcapNgByteOrderMagic {
+					order = binary.BigEndian
+				}
+			}
+
+			blockLen := int64(order.Uint32(buf[4:8]))
+			if blockLen < 12 || blockLen%4 != 0 {
+				return length, nil
+			}
+			if n, _ := br.Discard(int(blockLen - 12)); int64(n) != blockLen-12 {
+				return length, nil
+			}
+			length += blockLen
+		}
+	}
+
+	// Records: header (16 bytes) and data (incl_len bytes).
+	length = pcapFileHeaderLen
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return length, nil
+		}
+
+		inclLen := int64(header.byteOrder.Uint32(buf[8:12]))
+		if n, _ := br.Discard(int(inclLen)); int64(n) != inclLen {
+			return length, nil
+		}
+		length += pcapRecordHeaderLen + inclLen
+	}
+}
+
+// checkAppendFile checks the existing file before packets are appended to it.
+// It returns true if the file is empty (i.e., the file header must be
+// written), or errHeaderMismatch if the header does not match. A record or
+// block partially written at the end of the file is truncated.
+func checkAppendFile(filename string, format string, nanos bool, interfaces []captureInterface) (bool, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	if format != FormatPcapNg && info.Size() < pcapFileHeaderLen {
+		// The file header is partially written.
+		slog.Warn("truncate a partially-written file header", "file", filename, "bytes", info.Size())
+		return true, f.Truncate(0)
+	}
+
+	var header *pcapFileHeader
+
+	if format == FormatPcapNg {
+		var buf [4]byte
+		if _, err := io.ReadFull(f, buf[:]); err != nil || binary.LittleEndian.Uint32(buf[:]) != pcapNgBlockTypeSHB {
+			return false, fmt.Errorf("%w: not a pcapng file", errHeaderMismatch)
+		}
+	} else {
+		header, err = readPcapFileHeader(f)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", errHeaderMismatch, err)
+		}
+		if err := validatePcapFileHeader(header, nanos, interfaces); err != nil {
+			return false, err
+		}
+	}
+
+	// Blocks of pcapng are read from the beginning (records of pcap are read
+	// after the file header).
+	if format == FormatPcapNg {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	}
+
+	length, err := completeLength(f, format, header)
+	if err != nil {
+		return false, err
+	}
+
+	if length < info.Size() {
+		slog.Warn("truncate a partially-written record", "file", filename, "bytes", info.Size(), "truncatedBytes", length)
+		if err := f.Truncate(length); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// prepareAppend returns the file to append packets to and true if the file is
+// new or empty. If the existing file does not match the Writer, the file with
+// the next suffix is tried (AppendMismatch is "suffix"), or an error is
+// returned ("fail").
+func (w *Writer) prepareAppend(fileName string) (string, bool, error) {
+	c := &w.config.Rcap
+	nanos := c.TimestampPrecision == TimestampPrecisionNano
+	baseFileName := fileName
+
+	for i := 1; ; i++ {
+		if !FileExists(fileName) {
+			return fileName, true, nil
+		}
+
+		isEmpty, err := checkAppendFile(fileName, c.OutputFormat, nanos, w.interfaces)
+		if err == nil {
+			return fileName, isEmpty, nil
+		}
+		if !errors.Is(err, errHeaderMismatch) || c.AppendMismatch == AppendMismatchFail {
+			return "", false, fmt.Errorf("cannot append to the existing file: %v (%w)", fileName, err)
+		}
+
+		slog.Warn("cannot append to the existing file", "file", fileName, "error", err)
+		fileName = suffixedFileName(baseFileName, i)
+	}
+}
@@ -0,0 +1,206 @@
+package rcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// make a file with the given number of packets written by newPacketWriter.
+func makeAppendFile(t *testing.T, filename string, format string, nanos bool, interfaces []captureInterface, numPackets int) int64 {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("failed to make file: %v", err)
+	}
+	defer f.Close()
+
+	w, err := newPacketWriter(f, true, format, nanos, interfaces)
+	if err != nil {
+		t.Fatalf("failed to make writer: %v", err)
+	}
+
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}
+	for i := 0; i < numPackets; i++ {
+		w.WritePacket(capinfo, data)
+	}
+	w.Flush()
+
+	info, _ := f.Stat()
+	return info.Size()
+}
+
+func TestReadPcapFileHeader(t *testing.T) {
+	interfaces := makeInterfaces(layers.LinkTypeEthernet)
+
+	for _, nanos := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		newPacketWriter(buf, true, FormatPcap, nanos, interfaces)
+
+		header, err := readPcapFileHeader(buf)
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if header.nanos != nanos || header.byteOrder != binary.LittleEndian || header.linkType != layers.LinkTypeEthernet {
+			t.Errorf("'%v' is expected, but got '%+v'.", nanos, header)
+		}
+	}
+
+	// Big endian (e.g. written on another machine).
+	data := append([]byte{0xa1, 0xb2, 0x3c, 0x4d}, make([]byte, 20)...)
+	if header, err := readPcapFileHeader(bytes.NewReader(data)); err != nil || !header.nanos || header.byteOrder != binary.BigEndian {
+		t.Errorf("the big endian header in nanoseconds is expected, but got '%+v' (err: %v).", header, err)
+	}
+
+	// Not a pcap file.
+	if _, err := readPcapFileHeader(bytes.NewReader(append([]byte("text"), make([]byte, 20)...))); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+
+	// Empty file.
+	if _, err := readPcapFileHeader(bytes.NewReader(nil)); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
+
+func TestValidatePcapFileHeader(t *testing.T) {
+	interfaces := makeInterfaces(layers.LinkTypeEthernet)
+
+	cases := []struct {
+		// in
+		header pcapFileHeader
+		nanos  bool
+		// out
+		match bool
+	}{
+		{pcapFileHeader{binary.LittleEndian, false, 65535, layers.LinkTypeEthernet}, false, true},
+		{pcapFileHeader{binary.LittleEndian, true, 65535, layers.LinkTypeEthernet}, true, true},
+		{pcapFileHeader{binary.LittleEndian, true, 65535, layers.LinkTypeEthernet}, false, false},
+		{pcapFileHeader{binary.LittleEndian, false, 1500, layers.LinkTypeEthernet}, false, false},
+		{pcapFileHeader{binary.LittleEndian, false, 65535, layers.LinkTypeLinuxSLL}, false, false},
+	}
+
+	for _, c := range cases {
+		err := validatePcapFileHeader(&c.header, c.nanos, interfaces)
+		if match := err == nil; match != c.match {
+			t.Errorf("'%v' is expected, but got '%v' (err: %v).", c.match, match, err)
+		}
+		if err != nil && !errors.Is(err, errHeaderMismatch) {
+			t.Errorf("errHeaderMismatch is expected, but got '%v'.", err)
+		}
+	}
+}
+
+func TestCheckAppendFile(t *testing.T) {
+	tempDir := t.TempDir()
+	interfaces := makeInterfaces(layers.LinkTypeEthernet)
+
+	for _, format := range []string{FormatPcap, FormatPcapNg} {
+		filename := filepath.Join(tempDir, "test."+format)
+		size := makeAppendFile(t, filename, format, false, interfaces, 2)
+
+		// A complete file.
+		if isEmpty, err := checkAppendFile(filename, format, false, interfaces); isEmpty || err != nil {
+			t.Errorf("'false' and nil are expected, but got '%v' and '%v'.", isEmpty, err)
+		}
+		if info, _ := os.Stat(filename); info.Size() != size {
+			t.Errorf("'%v' is expected, but got '%v'.", size, info.Size())
+		}
+
+		// A partially-written record is truncated.
+		f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+		f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+		f.Close()
+
+		if _, err := checkAppendFile(filename, format, false, interfaces); err != nil {
+			t.Errorf("nil is expected, but got '%v'.", err)
+		}
+		if info, _ := os.Stat(filename); info.Size() != size {
+			t.Errorf("'%v' is expected, but got '%v' (%v).", size, info.Size(), format)
+		}
+
+		// The truncated file can be read.
+		f, _ = os.Open(filename)
+		var numPackets int
+		if format == FormatPcapNg {
+			r, _ := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+			for _, _, err := r.ReadPacketData(); err == nil; _, _, err = r.ReadPacketData() {
+				numPackets++
+			}
+		} else {
+			r, _ := pcapgo.NewReader(f)
+			for _, _, err := r.ReadPacketData(); err == nil; _, _, err = r.ReadPacketData() {
+				numPackets++
+			}
+		}
+		f.Close()
+		if numPackets != 2 {
+			t.Errorf("2 packets are expected, but got %v packet(s) (%v).", numPackets, format)
+		}
+	}
+
+	// Header mismatch.
+	filename := filepath.Join(tempDir, "test.pcap")
+	if _, err := checkAppendFile(filename, FormatPcap, true, interfaces); !errors.Is(err, errHeaderMismatch) {
+		t.Errorf("errHeaderMismatch is expected, but got '%v'.", err)
+	}
+	if _, err := checkAppendFile(filename, FormatPcapNg, false, interfaces); !errors.Is(err, errHeaderMismatch) {
+		t.Errorf("errHeaderMismatch is expected, but got '%v'.", err)
+	}
+
+	// Empty file and partially-written file header.
+	for _, data := range [][]byte{{}, {0xd4, 0xc3, 0xb2, 0xa1, 0x02}} {
+		filename := filepath.Join(tempDir, "partial.pcap")
+		os.WriteFile(filename, data, 0644)
+		if isEmpty, err := checkAppendFile(filename, FormatPcap, false, interfaces); !isEmpty || err != nil {
+			t.Errorf("'true' and nil are expected, but got '%v' and '%v'.", isEmpty, err)
+		}
+		if info, _ := os.Stat(filename); info.Size() != 0 {
+			t.Errorf("an empty file is expected, but got %v bytes.", info.Size())
+		}
+	}
+}
+
+func TestWriterPrepareAppend(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test.pcap")
+	c.CheckAndFormat()
+
+	// The existing file has another linktype.
+	makeAppendFile(t, c.Rcap.FileFmt, FormatPcap, false, makeInterfaces(layers.LinkTypeLinuxSLL), 1)
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	fileName, isNewFile, err := w.prepareAppend(c.Rcap.FileFmt)
+	if err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if expected := filepath.Join(tempDir, "test-1.pcap"); fileName != expected || !isNewFile {
+		t.Errorf("'%v' (new file) is expected, but got '%v' (new file: %v).", expected, fileName, isNewFile)
+	}
+
+	// The file with the suffix is appended if it matches.
+	makeAppendFile(t, filepath.Join(tempDir, "test-1.pcap"), FormatPcap, false, makeInterfaces(layers.LinkTypeEthernet), 1)
+	fileName, isNewFile, _ = w.prepareAppend(c.Rcap.FileFmt)
+	if expected := filepath.Join(tempDir, "test-1.pcap"); fileName != expected || isNewFile {
+		t.Errorf("'%v' (existing file) is expected, but got '%v' (new file: %v).", expected, fileName, isNewFile)
+	}
+
+	// Fail.
+	c.Rcap.AppendMismatch = AppendMismatchFail
+	if _, _, err := w.prepareAppend(c.Rcap.FileFmt); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+	if err := w.openWriter(0); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
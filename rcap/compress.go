@@ -0,0 +1,137 @@
+package rcap
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	// CompressionNone writes files without compression.
+	CompressionNone = "none"
+	// CompressionGzip compresses files with gzip (.gz).
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses files with zstd (.zst).
+	CompressionZstd = "zstd"
+	// CompressionLz4 compresses files with lz4 (.lz4).
+	CompressionLz4 = "lz4"
+
+	// CompressionModeStream compresses packets while writing them, so files
+	// on disk are always compressed.
+	CompressionModeStream = "stream"
+	// CompressionModeRotate compresses files in background after they are
+	// rotated (closed).
+	CompressionModeRotate = "rotate"
+)
+
+var (
+	// backgroundJobs holds jobs (e.g. compression of rotated files) running
+	// in background. Run waits for them before exiting.
+	backgroundJobs sync.WaitGroup
+)
+
+// compressionExt returns the file extension of the compression algorithm.
+func compressionExt(algorithm string) string {
+	switch algorithm {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	case CompressionLz4:
+		return ".lz4"
+	default:
+		return ""
+	}
+}
+
+// newCompressor returns an io.WriteCloser which compresses data with the
+// algorithm and writes them to w. Close must be called to write out the end
+// of the compressed stream (the underlying writer is not closed).
+func newCompressor(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case CompressionLz4:
+		// Small blocks keep the memory per file low and make flushed data
+		// decompressible sooner.
+		z := lz4.NewWriter(w)
+		if err := z.Apply(lz4.BlockSizeOption(lz4.Block64Kb)); err != nil {
+			return nil, err
+		}
+		return z, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: '%v'", algorithm)
+	}
+}
+
+// compressFile compresses the file with the algorithm, removes the original
+// file and returns the filename of the compressed file. The compressed file is
+// written under a temporary name and renamed when it is complete, so it is
+// never seen partially written. The original file is kept if the compression
+// fails.
+func compressFile(filename string, algorithm string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dstName := filename + compressionExt(algorithm)
+	if _, err := os.Lstat(dstName); err == nil {
+		return "", fmt.Errorf("file already exists: '%v'", dstName)
+	}
+
+	err = writeFileAtomic(dstName, func(w io.Writer) error {
+		compressor, err := newCompressor(w, algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(compressor, src); err != nil {
+			return err
+		}
+		return compressor.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dstName, os.Remove(filename)
+}
+
+// compressFileInBackground compresses the file in a goroutine. done (if not
+// nil) is called with the compressed file, or the original file if the
+// compression fails. Both files are kept from the retention policy until done
+// returns.
+func compressFileInBackground(filename string, algorithm string, done func(string)) {
+	dstName := filename + compressionExt(algorithm)
+	holdFile(filename)
+	holdFile(dstName)
+
+	backgroundJobs.Add(1)
+
+	go func() {
+		defer backgroundJobs.Done()
+		defer releaseFile(filename)
+		defer releaseFile(dstName)
+
+		compressed, err := compressFile(filename, algorithm)
+		if err != nil {
+			slog.Error("failed to compress file", "file", filename, "error", err)
+			compressed = filename
+		} else {
+			slog.Info("compress file", "file", filename, "compressedFile", compressed)
+		}
+
+		if done != nil {
+			done(compressed)
+		}
+	}()
+}
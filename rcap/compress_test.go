@@ -0,0 +1,185 @@
+package rcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestCompressionExt(t *testing.T) {
+	cases := []struct {
+		// in
+		algorithm string
+		// out
+		ext string
+	}{
+		{CompressionNone, ""},
+		{CompressionGzip, ".gz"},
+		{CompressionZstd, ".zst"},
+		{CompressionLz4, ".lz4"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if ext := compressionExt(c.algorithm); ext != c.ext {
+			t.Errorf("'%v' is expected, but got '%v'.", c.ext, ext)
+		}
+	}
+}
+
+func TestNewCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("this is a test packet.\n"), 10000)
+
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd, CompressionLz4} {
+		buf := &bytes.Buffer{}
+		w, err := newCompressor(buf, algorithm)
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		w.Write(data)
+		w.Close()
+
+		if buf.Len() >= len(data) {
+			t.Errorf("data are not compressed by %v: %v >= %v", algorithm, buf.Len(), len(data))
+		}
+
+		var r io.Reader
+		switch algorithm {
+		case CompressionGzip:
+			r, _ = gzip.NewReader(buf)
+		case CompressionZstd:
+			r, _ = zstd.NewReader(buf)
+		case CompressionLz4:
+			r = lz4.NewReader(buf)
+		}
+
+		got, _ := io.ReadAll(r)
+		if !cmp.Equal(got, data) {
+			t.Errorf("decompressed data by %v are different from the original data.", algorithm)
+		}
+	}
+
+	if _, err := newCompressor(&bytes.Buffer{}, CompressionNone); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+}
+
+func TestLz4Compressor(t *testing.T) {
+	// More than a block (64KB) of incompressible data.
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	buf := &bytes.Buffer{}
+	w, _ := newCompressor(buf, CompressionLz4)
+	w.Write(data[:100])
+
+	// The data written so far can be decompressed after Flush.
+	if err := w.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	got, _ := io.ReadAll(lz4.NewReader(bytes.NewReader(buf.Bytes())))
+	if !cmp.Equal(got, data[:100]) {
+		t.Errorf("%v bytes are expected, but got %v bytes.", 100, len(got))
+	}
+
+	w.Write(data[100:])
+	if err := w.Close(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	got, err := io.ReadAll(lz4.NewReader(buf))
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if !cmp.Equal(got, data) {
+		t.Errorf("%v bytes are expected, but got %v bytes.", len(data), len(got))
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := filepath.Join(tempDir, "test.pcap")
+	data := []byte("this is a test packet.\n")
+	os.WriteFile(filename, data, 0644)
+
+	compressed, err := compressFile(filename, CompressionGzip)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if compressed != filename+".gz" {
+		t.Errorf("'%v' is expected, but got '%v'.", filename+".gz", compressed)
+	}
+	if FileExists(filename) {
+		t.Errorf("'%v' is expected to be removed.", filename)
+	}
+
+	f, _ := os.Open(compressed)
+	defer f.Close()
+	r, _ := gzip.NewReader(f)
+	if got, _ := io.ReadAll(r); !cmp.Equal(got, data) {
+		t.Errorf("'%v' is expected, but got '%v'.", data, got)
+	}
+
+	// file not found.
+	if _, err := compressFile(filename, CompressionGzip); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+
+	// The compressed file already exists.
+	os.WriteFile(filename, data, 0644)
+	if _, err := compressFile(filename, CompressionGzip); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+	if !FileExists(filename) {
+		t.Errorf("'%v' is expected to be kept.", filename)
+	}
+
+	// No compressed file is left if the compression fails (a directory cannot
+	// be read).
+	dirName := filepath.Join(tempDir, "dir.pcap")
+	os.Mkdir(dirName, 0755)
+	if _, err := compressFile(dirName, CompressionGzip); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+	if FileExists(dirName+".gz") || FileExists(dirName+".gz.tmp") {
+		t.Errorf("'%v' is expected not to exist.", dirName+".gz")
+	}
+}
+
+func TestCompressFileAtomic(t *testing.T) {
+	// The source is a named pipe, so the files can be checked while the source
+	// is being compressed.
+	src := filepath.Join(t.TempDir(), "test.pcap")
+	if err := syscall.Mkfifo(src, 0644); err != nil {
+		t.Skipf("named pipes are not supported: %v", err)
+	}
+
+	done := make(chan string)
+	go func() {
+		compressed, _ := compressFile(src, CompressionGzip)
+		done <- compressed
+	}()
+
+	// Opening the pipe waits for compressFile to open it.
+	w, _ := os.OpenFile(src, os.O_WRONLY, 0)
+	w.Write([]byte("this is a test packet.\n"))
+	time.Sleep(100 * time.Millisecond)
+	if FileExists(src+".gz") || !FileExists(src+".gz.tmp") {
+		t.Errorf("only '%v' is expected to exist while compressing.", src+".gz.tmp")
+	}
+
+	w.Close()
+	if compressed := <-done; compressed != src+".gz" || !FileExists(compressed) || FileExists(src+".gz.tmp") {
+		t.Errorf("only '%v' is expected to exist after compressing.", src+".gz")
+	}
+}
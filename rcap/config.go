@@ -2,8 +2,10 @@ package rcap
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -25,15 +27,30 @@ type Config struct {
 // TODO: Add validator of Device and BpfRules.
 type RcapConfig struct {
 	// Params for libpcap.
-	Device   string `toml:"device" default:"any" validate:"required"`    // Device name.
-	SnapLen  uint   `toml:"snaplen" default:"65535" validate:"gte=0"`    // Snap length.
-	Promisc  bool   `toml:"promisc" default:"true"`                      // Promiscuous mode.
-	ToMs     uint   `toml:"toMs" default:"100" validate:"gte=1,lte=500"` // Timeout when no packets are captured.
-	BpfRules string `toml:"bpfRules" default:""`                         // BPF rules.
+	Device   string         `toml:"device" default:"any" validate:"required"`    // Device name(s) separated by comma.
+	SnapLen  uint           `toml:"snaplen" default:"65535" validate:"gte=0"`    // Snap length.
+	Promisc  bool           `toml:"promisc" default:"true"`                      // Promiscuous mode.
+	ToMs     uint           `toml:"toMs" default:"100" validate:"gte=1,lte=500"` // Timeout when no packets are captured.
+	BpfRules string         `toml:"bpfRules" default:""`                         // BPF rules.
+	Devices  []DeviceConfig `toml:"devices" validate:"dive"`                     // Devices (Device is ignored if set).
+
+	// Params for offline replay.
+	ReadFiles []string `toml:"readFiles"` // Pcap files (or globs) to read instead of devices.
+
+	// Params for the capture handle.
+	BufferSize         int    `toml:"bufferSize" default:"0" validate:"gte=0"`                        // Kernel buffer size in bytes (libpcap default if 0).
+	ImmediateMode      bool   `toml:"immediateMode" default:"false"`                                  // Deliver packets as soon as they arrive.
+	TimestampPrecision string `toml:"timestampPrecision" default:"micro" validate:"oneof=micro nano"` // Precision of timestamps.
+	TimestampType      string `toml:"timestampType" default:""`                                       // Source of timestamps (libpcap default if empty).
+
+	// Params for the queue between capture and write.
+	QueueSize   uint   `toml:"queueSize" default:"8192" validate:"gte=1"`               // Max number of packets in the queue.
+	QueuePolicy string `toml:"queuePolicy" default:"block" validate:"oneof=block drop"` // Policy if the queue is full.
 
 	// Params for this program.
 	FileFmt       string         `toml:"fileFmt" default:"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap" validate:"filepath"` // Path to PCAP files.
 	FileAppend    bool           `toml:"fileAppend" default:"true"`                                                   // Append data if the file exists.
+	OutputFormat  string         `toml:"outputFormat" default:"pcap" validate:"oneof=pcap pcapng"`                    // Format of output files.
 	Timezone      string         `toml:"timezone" default:"UTC" validate:"timezone"`                                  // Timezone used for FileFmt.
 	Location      *time.Location // Location data (i.e., Timezone)
 	Interval      int64          `toml:"interval" default:"60" validate:"gte=0"`        // Rotation interval (in second).
@@ -41,8 +58,202 @@ type RcapConfig struct {
 	UTCOffset     time.Duration  `toml:"utcOffset" default:"0"`                         // Rotation offset from UTC (in second).
 	Sampling      float64        `toml:"sampling" default:"1.0" validate:"gte=0,lte=1"` // Sampling rate.
 	SamplingMode  bool           // Sampling mode.
-	LogFile       string         `toml:"logFile" default:"" validate:"omitempty,filepath"` // Deprecated: Log file.
+	LogFile       string         `toml:"logFile" default:"" validate:"omitempty,filepath"` // Log file (stderr if empty).
 	UseSystemTime bool           `toml:"useSystemTime" default:"false"`                    // Use system time or packet-captured time.
+
+	// Params for sampling (see Sampling).
+	SamplingStrategy string `toml:"samplingStrategy" default:"random" validate:"oneof=random flow nth"` // Strategy of sampling.
+	SamplingSeed     int64  `toml:"samplingSeed" default:"0"`                                           // Seed of sampling (0 means the current time for random).
+
+	// Params for rate limiting (0 means no limit).
+	RateLimitPackets   float64 `toml:"rateLimitPackets" default:"0" validate:"gte=0"` // Max packets per second.
+	RateLimitBytes     float64 `toml:"rateLimitBytes" default:"0" validate:"gte=0"`   // Max bytes per second.
+	RateLimitPerSource bool    `toml:"rateLimitPerSource" default:"false"`            // Limit packets per source IP address.
+
+	// Params for truncation of payloads (the first matching rule is applied).
+	Truncate []TruncateRule `toml:"truncate" validate:"dive"` // Rules of truncation.
+
+	// Params for anonymization of IP addresses.
+	AnonymizeKey   string        `toml:"anonymizeKey" default:"" validate:"omitempty,len=64,hexadecimal"` // Hex-encoded key of prefix-preserving anonymization (disabled if empty).
+	AnonymizeAddrs []AddrMapping `toml:"anonymizeAddrs" validate:"dive"`                                  // Fixed mapping of addresses.
+
+	// Params for outputs (FileFmt and Interval are used if empty).
+	Sinks []SinkConfig `toml:"sinks" validate:"unique=Name,unique=FileFmt,dive"` // Outputs of packets matching their rules.
+
+	// Params for the ring buffer.
+	RingFiles uint `toml:"ringFiles" default:"0"` // Number of files to cycle through (disabled if 0).
+
+	// Params for the trigger mode.
+	Trigger         bool          `toml:"trigger" default:"false"`                                   // Write packets only around triggers.
+	TriggerFilter   string        `toml:"triggerFilter" default:""`                                  // BPF rules of packets which fire the trigger (disabled if empty).
+	TriggerPre      time.Duration `toml:"triggerPre" default:"10s" validate:"gte=0"`                 // Duration of packets kept in memory before the trigger.
+	TriggerPreBytes int64         `toml:"triggerPreBytes" default:"67108864" validate:"gte=0"`       // Max bytes of packets kept in memory (0 means no limit).
+	TriggerPost     time.Duration `toml:"triggerPost" default:"10s" validate:"gte=0"`                // Duration of packets written after the trigger.
+	TriggerAddr     string        `toml:"triggerAddr" default:"" validate:"omitempty,hostname_port"` // Address of the HTTP endpoint to fire the trigger (disabled if empty).
+
+	// Params for logging.
+	LogFormat string `toml:"logFormat" default:"text" validate:"oneof=text json"`            // Format of logs.
+	LogLevel  string `toml:"logLevel" default:"info" validate:"oneof=debug info warn error"` // Minimum level of logs.
+
+	// Params for appending to existing files.
+	AppendMismatch string `toml:"appendMismatch" default:"suffix" validate:"oneof=suffix fail"` // Policy if the existing file does not match.
+
+	// Params for compression.
+	Compression     string `toml:"compression" default:"none" validate:"oneof=none gzip zstd lz4"`  // Compression of output files.
+	CompressionMode string `toml:"compressionMode" default:"stream" validate:"oneof=stream rotate"` // Compress files in-stream or after rotation.
+
+	// Params for files in progress.
+	PartFiles  string `toml:"partFiles" default:"none" validate:"oneof=none suffix dot"`          // Naming of files in progress.
+	PartSuffix string `toml:"partSuffix" default:".part" validate:"required_if=PartFiles suffix"` // Suffix of files in progress if PartFiles is "suffix".
+
+	// Params for buffered writes.
+	WriteBufferSize int           `toml:"writeBufferSize" default:"65536" validate:"gte=0"`                        // Size of the buffer of files in bytes (unbuffered if 0).
+	FlushInterval   time.Duration `toml:"flushInterval" default:"1s" validate:"gte=0"`                             // Interval to flush the buffer (only at close if 0).
+	FsyncPolicy     string        `toml:"fsyncPolicy" default:"never" validate:"oneof=never rotate interval"`      // When files are synced to the disk.
+	FsyncInterval   time.Duration `toml:"fsyncInterval" default:"10s" validate:"required_if=FsyncPolicy interval"` // Interval to sync files if FsyncPolicy is "interval".
+
+	// Params for size-based rotation (0 means no limit).
+	MaxFileBytes   int64 `toml:"maxFileBytes" default:"0" validate:"gte=0"` // Max bytes of a file.
+	MaxFilePackets uint  `toml:"maxFilePackets" default:"0"`                // Max number of packets in a file.
+
+	// Params for metrics and statistics.
+	MetricsAddr   string  `toml:"metricsAddr" default:"" validate:"omitempty,hostname_port"` // Address of the HTTP endpoint (disabled if empty).
+	DropWarnRatio float64 `toml:"dropWarnRatio" default:"0.01" validate:"gte=0,lte=1"`       // Warn if the drop ratio exceeds this (disabled if 0).
+
+	// Params for retention (0 means no limit).
+	RetentionMaxAge       time.Duration `toml:"retentionMaxAge" default:"0" validate:"gte=0"`   // Max age of files.
+	RetentionMaxBytes     int64         `toml:"retentionMaxBytes" default:"0" validate:"gte=0"` // Max total bytes of files.
+	RetentionMaxFiles     uint          `toml:"retentionMaxFiles" default:"0"`                  // Max number of files.
+	RetentionMinFreeBytes uint64        `toml:"retentionMinFreeBytes" default:"0"`              // Min free bytes of the disk.
+
+	// Params for manifests of closed files.
+	Manifest      bool   `toml:"manifest" default:"false"`                               // Write a JSON sidecar file per closed file.
+	ManifestIndex string `toml:"manifestIndex" default:"" validate:"omitempty,filepath"` // JSON Lines file listing all closed files (disabled if empty).
+
+	// Params for the hook executed after each file is closed.
+	HookCommand     string        `toml:"hookCommand" default:""`                       // Command template (disabled if empty).
+	HookTimeout     time.Duration `toml:"hookTimeout" default:"1m" validate:"gte=0"`    // Timeout of the command (0 means no timeout).
+	HookConcurrency uint          `toml:"hookConcurrency" default:"1" validate:"gte=1"` // Max number of commands running at once.
+}
+
+// DeviceConfig struct is a section of a device to capture packets on.
+type DeviceConfig struct {
+	Name     string `toml:"name" validate:"required"` // Device name.
+	BpfRules string `toml:"bpfRules"`                 // BPF rules (RcapConfig.BpfRules is used if empty).
+	SnapLen  uint   `toml:"snaplen"`                  // Snap length (RcapConfig.SnapLen is used if 0).
+}
+
+// TruncateRule struct is a section of a rule to truncate payloads of packets.
+type TruncateRule struct {
+	Protocol   string `toml:"protocol" validate:"oneof=any tcp udp icmp dns tls"` // Protocol of packets.
+	Ports      []uint `toml:"ports" validate:"dive,lte=65535"`                    // Source or destination ports (any port if empty).
+	MaxPayload int    `toml:"maxPayload" default:"-1" validate:"gte=-1"`          // Max bytes of payload (-1 keeps all, 0 keeps headers only).
+}
+
+// AddrMapping struct is a section of an IP address replaced with another one.
+type AddrMapping struct {
+	From string `toml:"from" validate:"ip"` // Original address.
+	To   string `toml:"to" validate:"ip"`   // Replaced address (the same family as From).
+}
+
+// SinkConfig struct is a section of an output which packets matching its rules
+// are written to. Packets are matched against the sinks in order, and written
+// to the first matching sink (and the following ones if Continue is set).
+type SinkConfig struct {
+	Name             string  `toml:"name" validate:"required"`                                         // Name of the sink.
+	Filter           string  `toml:"filter"`                                                           // BPF rules of packets (all packets if empty).
+	Protocol         string  `toml:"protocol" default:"any" validate:"oneof=any tcp udp icmp dns tls"` // Protocol of packets.
+	Ports            []uint  `toml:"ports" validate:"dive,lte=65535"`                                  // Source or destination ports (any port if empty).
+	FileFmt          string  `toml:"fileFmt" validate:"required,filepath"`                             // Path to PCAP files.
+	Interval         int64   `toml:"interval" default:"60" validate:"gte=0"`                           // Rotation interval (in second).
+	Sampling         float64 `toml:"sampling" default:"1.0" validate:"gte=0,lte=1"`                    // Sampling rate (applied after RcapConfig.Sampling).
+	SamplingStrategy string  `toml:"samplingStrategy" validate:"omitempty,oneof=random flow nth"`      // Strategy of sampling (RcapConfig.SamplingStrategy is used if empty).
+	Continue         bool    `toml:"continue" default:"false"`                                         // Match packets against the following sinks too.
+}
+
+// CaptureDevices returns the devices to capture packets on. If Devices is
+// empty, the devices are made from the comma-separated names in Device.
+// Empty BpfRules and SnapLen of each device are filled with the global ones.
+func (r *RcapConfig) CaptureDevices() []DeviceConfig {
+	var devices []DeviceConfig
+
+	if len(r.Devices) > 0 {
+		devices = append(devices, r.Devices...)
+	} else {
+		for _, name := range strings.Split(r.Device, ",") {
+			devices = append(devices, DeviceConfig{Name: strings.TrimSpace(name)})
+		}
+	}
+
+	for i := range devices {
+		if devices[i].BpfRules == "" {
+			devices[i].BpfRules = r.BpfRules
+		}
+		if devices[i].SnapLen == 0 {
+			devices[i].SnapLen = r.SnapLen
+		}
+	}
+
+	return devices
+}
+
+// OutputSinks returns the sinks to write packets to. If Sinks is empty, a sink
+// of all packets is made from FileFmt and Interval. Empty SamplingStrategy of
+// each sink is filled with the global one.
+func (r *RcapConfig) OutputSinks() []SinkConfig {
+	var sinks []SinkConfig
+
+	if len(r.Sinks) > 0 {
+		sinks = append(sinks, r.Sinks...)
+	} else {
+		sinks = append(sinks, SinkConfig{
+			Name:     DefaultSinkName,
+			Protocol: TruncateAny,
+			FileFmt:  r.FileFmt,
+			Interval: r.Interval,
+			Sampling: 1.0,
+		})
+	}
+
+	for i := range sinks {
+		if sinks[i].SamplingStrategy == "" {
+			sinks[i].SamplingStrategy = r.SamplingStrategy
+		}
+	}
+
+	return sinks
+}
+
+// OfflineMode returns true if packets are read from pcap files (ReadFiles)
+// instead of devices.
+func (r *RcapConfig) OfflineMode() bool {
+	return len(r.ReadFiles) > 0
+}
+
+// ReadFileNames returns the files matching the patterns (globs) in ReadFiles.
+// The files are in the order of the patterns, and sorted by name for each
+// pattern.
+func (r *RcapConfig) ReadFileNames() ([]string, error) {
+	var files []string
+
+	for _, pattern := range r.ReadFiles {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: '%v' (%w)", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match: '%v'", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// SplitByDevice returns true if packets are written to a file per device
+// (i.e., FileFmt contains the %i token).
+func (r *RcapConfig) SplitByDevice() bool {
+	return strings.Contains(r.FileFmt, DeviceToken)
 }
 
 func isValidDevice(name string) bool {
@@ -69,7 +280,7 @@ func isValidBpf(bpf string, device string, captureLength uint) bool {
 
 	// For test
 	linkType := layers.LinkTypeEthernet
-	log.Printf("The device linktype could not be detected. '%v' is used anyway.", linkType)
+	slog.Warn("the device linktype could not be detected, use the default linktype anyway.", "device", device, "linktype", linkType)
 	_, err = pcap.CompileBPFFilter(linkType, int(captureLength), bpf)
 
 	return err == nil
@@ -93,9 +304,42 @@ func (c *Config) CheckAndFormat() error {
 	if err := validate.Struct(c); err != nil {
 		return err
 	}
-	if err := CheckDeviceAndBpf(c.Rcap.Device, c.Rcap.BpfRules, c.Rcap.SnapLen); err != nil {
+	if c.Rcap.TimestampType != "" {
+		if _, err := pcap.TimestampSourceFromString(c.Rcap.TimestampType); err != nil {
+			return fmt.Errorf("invalid timestamp type: '%v'", c.Rcap.TimestampType)
+		}
+	}
+	if _, err := newAnonymizer(&c.Rcap); err != nil {
 		return err
 	}
+	if c.Rcap.RingFiles > 0 {
+		for _, sink := range c.Rcap.OutputSinks() {
+			if hasTimeDirective(sink.FileFmt) {
+				return fmt.Errorf("fileFmt must not contain strftime directives in the ring buffer mode: '%v'", sink.FileFmt)
+			}
+		}
+	}
+	// The linktype is unknown until the devices are opened.
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(c.Rcap.SnapLen), c.Rcap.TriggerFilter); err != nil {
+		return fmt.Errorf("invalid BPF of trigger: '%v'", c.Rcap.TriggerFilter)
+	}
+	for _, sink := range c.Rcap.Sinks {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(c.Rcap.SnapLen), sink.Filter); err != nil {
+			return fmt.Errorf("invalid BPF of sink '%v': '%v'", sink.Name, sink.Filter)
+		}
+	}
+	if c.Rcap.OfflineMode() {
+		// BPF rules are checked when the files are opened.
+		if _, err := c.Rcap.ReadFileNames(); err != nil {
+			return err
+		}
+	} else {
+		for _, device := range c.Rcap.CaptureDevices() {
+			if err := CheckDeviceAndBpf(device.Name, device.BpfRules, device.SnapLen); err != nil {
+				return err
+			}
+		}
+	}
 
 	// no error is returned from LoadLocation because validator checks timezone value.
 	c.Rcap.Location, _ = time.LoadLocation(c.Rcap.Timezone)
@@ -104,27 +348,101 @@ func (c *Config) CheckAndFormat() error {
 	return nil
 }
 
-// PrintToLog method prints config values to its log.
+// PrintToLog method prints config values to its log as a record.
 func (c *Config) PrintToLog() {
 	r := &c.Rcap
 
-	log.Printf("==== RCAP Config ====\n")
-	log.Printf("- Filename: %v\n", c.Filename)
-	log.Printf("- RCAP:\n")
-	log.Printf("  - device:	%v\n", r.Device)
-	log.Printf("  - snaplen:	%v\n", r.SnapLen)
-	log.Printf("  - promisc:	%v\n", r.Promisc)
-	log.Printf("  - toMs:	%v\n", r.ToMs)
-	log.Printf("  - bpfRules:	%v\n", r.BpfRules)
-	log.Printf("  - fileFmt:	%v\n", r.FileFmt)
-	log.Printf("  - fileAppend:	%v\n", r.FileAppend)
-	log.Printf("  - timezone:	%v (location: %v)\n", r.Timezone, r.Location)
-	log.Printf("  - interval:	%v\n", r.Interval)
-	log.Printf("  - offset:	%v\n", r.Offset)
-	log.Printf("  - utcOffset:	%v\n", r.UTCOffset)
-	log.Printf("  - sampling:	%v (samplingMode: %v)\n", r.Sampling, r.SamplingMode)
-	log.Printf("  - useSystemTime:	%v\n", r.UseSystemTime)
-	log.Printf("=====================\n")
+	var devices []string
+	for _, device := range r.CaptureDevices() {
+		devices = append(devices, fmt.Sprintf("%v (snaplen: %v, bpfRules: %v)", device.Name, device.SnapLen, device.BpfRules))
+	}
+
+	var truncateRules []string
+	for _, rule := range r.Truncate {
+		truncateRules = append(truncateRules, fmt.Sprintf("%v (ports: %v, maxPayload: %v)", rule.Protocol, rule.Ports, rule.MaxPayload))
+	}
+
+	var sinks []string
+	for _, sink := range r.Sinks {
+		sinks = append(sinks, fmt.Sprintf("%v (filter: %v, protocol: %v, ports: %v, fileFmt: %v, interval: %v, sampling: %v, samplingStrategy: %v, continue: %v)",
+			sink.Name, sink.Filter, sink.Protocol, sink.Ports, sink.FileFmt, sink.Interval, sink.Sampling, sink.SamplingStrategy, sink.Continue))
+	}
+
+	var location string
+	if r.Location != nil {
+		location = r.Location.String()
+	}
+
+	slog.Info("rcap config",
+		"filename", c.Filename,
+		slog.Group("rcap",
+			"device", r.Device,
+			"snaplen", r.SnapLen,
+			"promisc", r.Promisc,
+			"toMs", r.ToMs,
+			"bpfRules", r.BpfRules,
+			"devices", devices,
+			"readFiles", r.ReadFiles,
+			"bufferSize", r.BufferSize,
+			"immediateMode", r.ImmediateMode,
+			"timestampPrecision", r.TimestampPrecision,
+			"timestampType", r.TimestampType,
+			"queueSize", r.QueueSize,
+			"queuePolicy", r.QueuePolicy,
+			"fileFmt", r.FileFmt,
+			"fileAppend", r.FileAppend,
+			"outputFormat", r.OutputFormat,
+			"timezone", r.Timezone,
+			"location", location,
+			"interval", r.Interval,
+			"offset", r.Offset,
+			"utcOffset", r.UTCOffset.String(),
+			"sampling", r.Sampling,
+			"samplingMode", r.SamplingMode,
+			"samplingStrategy", r.SamplingStrategy,
+			"samplingSeed", r.SamplingSeed,
+			"rateLimitPackets", r.RateLimitPackets,
+			"rateLimitBytes", r.RateLimitBytes,
+			"rateLimitPerSource", r.RateLimitPerSource,
+			"truncate", truncateRules,
+			"anonymizeKey", strings.Repeat("*", len(r.AnonymizeKey)),
+			"anonymizeAddrs", r.AnonymizeAddrs,
+			"sinks", sinks,
+			"ringFiles", r.RingFiles,
+			"trigger", r.Trigger,
+			"triggerFilter", r.TriggerFilter,
+			"triggerPre", r.TriggerPre.String(),
+			"triggerPreBytes", r.TriggerPreBytes,
+			"triggerPost", r.TriggerPost.String(),
+			"triggerAddr", r.TriggerAddr,
+			"logFile", r.LogFile,
+			"logFormat", r.LogFormat,
+			"logLevel", r.LogLevel,
+			"useSystemTime", r.UseSystemTime,
+			"appendMismatch", r.AppendMismatch,
+			"compression", r.Compression,
+			"compressionMode", r.CompressionMode,
+			"partFiles", r.PartFiles,
+			"partSuffix", r.PartSuffix,
+			"writeBufferSize", r.WriteBufferSize,
+			"flushInterval", r.FlushInterval.String(),
+			"fsyncPolicy", r.FsyncPolicy,
+			"fsyncInterval", r.FsyncInterval.String(),
+			"maxFileBytes", r.MaxFileBytes,
+			"maxFilePackets", r.MaxFilePackets,
+			"retentionMaxAge", r.RetentionMaxAge.String(),
+			"retentionMaxBytes", r.RetentionMaxBytes,
+			"retentionMaxFiles", r.RetentionMaxFiles,
+			"retentionMinFreeBytes", r.RetentionMinFreeBytes,
+			"metricsAddr", r.MetricsAddr,
+			"dropWarnRatio", r.DropWarnRatio,
+			"manifest", r.Manifest,
+			"manifestIndex", r.ManifestIndex,
+			"hookCommand", r.HookCommand,
+			"hookTimeout", r.HookTimeout.String(),
+			"hookConcurrency", r.HookConcurrency,
+		),
+	)
 }
 
 // LoadConfig loads a configuration from the given filename and returns an
@@ -145,7 +463,7 @@ func LoadConfig(filename string) (*Config, error) {
 		valErrs, ok := err.(validator.ValidationErrors)
 		if ok {
 			for _, valErr := range valErrs {
-				log.Println(valErr.Error())
+				slog.Error("invalid config value", "error", valErr.Error())
 			}
 		}
 		return nil, fmt.Errorf("invalid config values: %w", err)
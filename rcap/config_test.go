@@ -2,6 +2,7 @@ package rcap
 
 import (
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/go-cmp/cmp"
@@ -87,6 +88,7 @@ func TestConfigDefaultValues(t *testing.T) {
 			BpfRules:      "",
 			FileFmt:       "dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap",
 			FileAppend:    true,
+			OutputFormat:  "pcap",
 			Timezone:      "UTC",
 			Location:      nil, // not set yet
 			Interval:      60,
@@ -95,6 +97,69 @@ func TestConfigDefaultValues(t *testing.T) {
 			SamplingMode:  false, // not set yet (default)
 			LogFile:       "",
 			UseSystemTime: false,
+
+			BufferSize:         0,
+			ImmediateMode:      false,
+			TimestampPrecision: "micro",
+			TimestampType:      "",
+
+			QueueSize:   8192,
+			QueuePolicy: "block",
+
+			SamplingStrategy: "random",
+			SamplingSeed:     0,
+
+			RateLimitPackets:   0,
+			RateLimitBytes:     0,
+			RateLimitPerSource: false,
+
+			Truncate: nil,
+
+			AnonymizeKey:   "",
+			AnonymizeAddrs: nil,
+
+			Sinks: nil,
+
+			RingFiles: 0,
+
+			Trigger:         false,
+			TriggerFilter:   "",
+			TriggerPre:      10 * time.Second,
+			TriggerPreBytes: 64 * 1024 * 1024,
+			TriggerPost:     10 * time.Second,
+			TriggerAddr:     "",
+
+			LogFormat: "text",
+			LogLevel:  "info",
+
+			AppendMismatch: "suffix",
+
+			Manifest:      false,
+			ManifestIndex: "",
+
+			HookCommand:     "",
+			HookTimeout:     time.Minute,
+			HookConcurrency: 1,
+
+			Compression:     "none",
+			CompressionMode: "stream",
+
+			PartFiles:  "none",
+			PartSuffix: ".part",
+
+			WriteBufferSize: 65536,
+			FlushInterval:   time.Second,
+			FsyncPolicy:     "never",
+			FsyncInterval:   10 * time.Second,
+
+			MaxFileBytes:          0,
+			MaxFilePackets:        0,
+			MetricsAddr:           "",
+			DropWarnRatio:         0.01,
+			RetentionMaxAge:       0,
+			RetentionMaxBytes:     0,
+			RetentionMaxFiles:     0,
+			RetentionMinFreeBytes: 0,
 		},
 	}
 
@@ -154,6 +219,205 @@ func TestConfigCheckAndFormatWithFailure(t *testing.T) {
 	if err == nil {
 		t.Error("err is expected, but got nil.")
 	}
+
+	c = makeConfig()
+	r = &c.Rcap
+
+	// invalid timestamp type
+	r.TimestampType = "invalid-type"
+
+	err = c.CheckAndFormat()
+	if err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+
+	c = makeConfig()
+	r = &c.Rcap
+
+	// no suffix of files in progress
+	r.PartFiles = "suffix"
+	r.PartSuffix = ""
+
+	err = c.CheckAndFormat()
+	if err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+
+	c = makeConfig()
+	r = &c.Rcap
+
+	// no fsync interval with the interval policy
+	r.FsyncPolicy = "interval"
+	r.FsyncInterval = 0
+
+	err = c.CheckAndFormat()
+	if err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+
+	c = makeConfig()
+	r = &c.Rcap
+
+	// invalid BPF of sink
+	r.Sinks = []SinkConfig{{Name: "test", Filter: "(invalid", Protocol: "any", FileFmt: "traffic.pcap"}}
+
+	err = c.CheckAndFormat()
+	if err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+
+	// strftime directives in the ring buffer mode
+	r.Sinks = nil
+	r.RingFiles = 10
+
+	err = c.CheckAndFormat()
+	if err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+
+	r.RingFiles = 0
+
+	// duplicate names or fileFmts of sinks
+	for _, sinks := range [][]SinkConfig{
+		{{Name: "a", Protocol: "any", FileFmt: "a.pcap"}, {Name: "a", Protocol: "any", FileFmt: "b.pcap"}},
+		{{Name: "a", Protocol: "any", FileFmt: "a.pcap"}, {Name: "b", Protocol: "any", FileFmt: "a.pcap"}},
+	} {
+		r.Sinks = sinks
+
+		err = c.CheckAndFormat()
+		if valErrs, _ := err.(validator.ValidationErrors); len(valErrs) != 1 {
+			t.Errorf("1 error is expected, but got '%v'.", err)
+		}
+	}
+}
+
+func TestConfigCaptureDevices(t *testing.T) {
+	c := makeConfig()
+	r := &c.Rcap
+	r.BpfRules = "ip"
+
+	// Devices from Device.
+	r.Device = "eth0, eth1"
+	expected := []DeviceConfig{
+		{Name: "eth0", BpfRules: "ip", SnapLen: 65535},
+		{Name: "eth1", BpfRules: "ip", SnapLen: 65535},
+	}
+	if got := r.CaptureDevices(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+
+	// Devices from Devices (Device is ignored).
+	r.Devices = []DeviceConfig{
+		{Name: "eth2"},
+		{Name: "eth3", BpfRules: "tcp", SnapLen: 128},
+	}
+	expected = []DeviceConfig{
+		{Name: "eth2", BpfRules: "ip", SnapLen: 65535},
+		{Name: "eth3", BpfRules: "tcp", SnapLen: 128},
+	}
+	if got := r.CaptureDevices(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+}
+
+func TestConfigReadFileNames(t *testing.T) {
+	c := makeConfig()
+	r := &c.Rcap
+
+	if r.OfflineMode() {
+		t.Errorf("'false' is expected, but got 'true'.")
+	}
+
+	r.ReadFiles = []string{"testdata/sample.pcap", "testdata/*.txt"}
+	if !r.OfflineMode() {
+		t.Errorf("'true' is expected, but got 'false'.")
+	}
+
+	files, err := r.ReadFileNames()
+	expected := []string{"testdata/sample.pcap", "testdata/19700101000000-data-1.txt", "testdata/19700101000000-data.txt"}
+	if err != nil || !cmp.Equal(files, expected) {
+		t.Errorf("'%v' is expected, but got '%v' (err: %v).", expected, files, err)
+	}
+	if err := c.CheckAndFormat(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+
+	// No files match.
+	r.ReadFiles = []string{"testdata/not-found-*.pcap"}
+	if _, err := r.ReadFileNames(); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+	if err := c.CheckAndFormat(); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
+
+func TestConfigOutputSinks(t *testing.T) {
+	c := makeConfig()
+	r := &c.Rcap
+
+	// The default sink from FileFmt and Interval.
+	expected := []SinkConfig{
+		{Name: DefaultSinkName, Protocol: "any", FileFmt: r.FileFmt, Interval: 60, Sampling: 1.0, SamplingStrategy: "random"},
+	}
+	if got := r.OutputSinks(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+
+	// Sinks from Sinks (FileFmt is ignored).
+	r.Sinks = []SinkConfig{
+		{Name: "a", Protocol: "dns", FileFmt: "a.pcap", Interval: 60, Sampling: 1.0},
+		{Name: "b", Protocol: "any", FileFmt: "b.pcap", Interval: 60, Sampling: 0.1, SamplingStrategy: "nth"},
+	}
+	expected = []SinkConfig{
+		{Name: "a", Protocol: "dns", FileFmt: "a.pcap", Interval: 60, Sampling: 1.0, SamplingStrategy: "random"},
+		{Name: "b", Protocol: "any", FileFmt: "b.pcap", Interval: 60, Sampling: 0.1, SamplingStrategy: "nth"},
+	}
+	if got := r.OutputSinks(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+}
+
+func TestConfigSplitByDevice(t *testing.T) {
+	c := makeConfig()
+	if c.Rcap.SplitByDevice() {
+		t.Error("'false' is expected, but got 'true'.")
+	}
+
+	c.Rcap.FileFmt = "dump/%i/traffic-%Y%m%d%H%M00.pcap"
+	if !c.Rcap.SplitByDevice() {
+		t.Error("'true' is expected, but got 'false'.")
+	}
+}
+
+func TestLoadConfigWithDevices(t *testing.T) {
+	c, err := LoadConfig("testdata/rcap-devices.toml")
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	expected := []DeviceConfig{
+		{Name: "any", BpfRules: "ip", SnapLen: 65535},
+		{Name: "lo", BpfRules: "tcp", SnapLen: 128},
+	}
+	if got := c.Rcap.CaptureDevices(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+}
+
+func TestLoadConfigWithSinks(t *testing.T) {
+	c, err := LoadConfig("testdata/rcap-sinks.toml")
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	expected := []SinkConfig{
+		{Name: "dns", Protocol: "dns", FileFmt: "dump/dns/%Y%m%d/dns-%Y%m%d%H%M00.pcap", Interval: 3600, Sampling: 1.0, SamplingStrategy: "flow", Continue: true},
+		{Name: "others", Filter: "ip or ip6", Protocol: "any", FileFmt: "dump/others/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", Interval: 60, Sampling: 0.1, SamplingStrategy: "random"},
+	}
+	if got := c.Rcap.OutputSinks(); !cmp.Equal(got, expected) {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
 }
 
 func TestLoadConfig(t *testing.T) {
@@ -0,0 +1,169 @@
+package rcap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// FormatPcap is the classic libpcap file format.
+	FormatPcap = "pcap"
+	// FormatPcapNg is the pcapng file format.
+	FormatPcapNg = "pcapng"
+
+	// Magic numbers of pcap files (in the byte order of the writer).
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+)
+
+// captureInterface is an interface whose packets are written by a Writer.
+type captureInterface struct {
+	device   DeviceConfig
+	linkType layers.LinkType
+}
+
+// ngInterface returns pcapgo.NgInterface describing the interface.
+func (i *captureInterface) ngInterface() pcapgo.NgInterface {
+	return pcapgo.NgInterface{
+		Name:       i.device.Name,
+		Filter:     i.device.BpfRules,
+		OS:         runtime.GOOS,
+		LinkType:   i.linkType,
+		SnapLength: uint32(i.device.SnapLen),
+	}
+}
+
+// packetWriter is the common interface of pcap and pcapng writers.
+type packetWriter interface {
+	WritePacket(capinfo gopacket.CaptureInfo, data []byte) error
+	// Flush writes out buffered data to the underlying writer.
+	Flush() error
+}
+
+// pcapWriter wraps pcapgo.Writer, which has no buffer to flush.
+type pcapWriter struct {
+	*pcapgo.Writer
+}
+
+func (w *pcapWriter) Flush() error {
+	return nil
+}
+
+// hostname returns the hostname of this machine or an empty string.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// newPcapNgWriter returns a pcapng writer which writes a Section Header Block
+// and an Interface Description Block per interface describing the capture.
+// The InterfaceIndex of packets is the index of interfaces.
+//
+// A new section is written even when appending to an existing file, so that
+// the appended packets are always described by their own interfaces.
+func newPcapNgWriter(w io.Writer, interfaces []captureInterface) (*pcapgo.NgWriter, error) {
+	options := pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    hostname(),
+			OS:          runtime.GOOS,
+			Application: "rcap",
+		},
+	}
+
+	writer, err := pcapgo.NewNgWriterInterface(w, interfaces[0].ngInterface(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, intf := range interfaces[1:] {
+		if _, err := writer.AddInterface(intf.ngInterface()); err != nil {
+			return nil, err
+		}
+	}
+
+	return writer, nil
+}
+
+// checkInterfaces returns an error if packets captured on the given interfaces
+// cannot be written to a file of the given format. A pcap file has only one
+// linktype in its header, so all interfaces must have the same linktype.
+func checkInterfaces(format string, interfaces []captureInterface) error {
+	if len(interfaces) == 0 {
+		return errors.New("no interface is given")
+	}
+
+	if format == FormatPcapNg {
+		return nil
+	}
+
+	for _, intf := range interfaces[1:] {
+		if intf.linkType != interfaces[0].linkType {
+			return fmt.Errorf("different linktypes cannot be written to a pcap file: %v (%v), %v (%v)",
+				interfaces[0].device.Name, interfaces[0].linkType, intf.device.Name, intf.linkType)
+		}
+	}
+
+	return nil
+}
+
+// newPcapWriter returns a pcap writer. The largest snaplen of the interfaces
+// is written to the file header. If nanos is true, timestamps are written in
+// nanoseconds (with the magic number 0xa1b23c4d).
+func newPcapWriter(w io.Writer, isNewFile bool, nanos bool, interfaces []captureInterface) (*pcapWriter, error) {
+	if err := checkInterfaces(FormatPcap, interfaces); err != nil {
+		return nil, err
+	}
+
+	snapLen, linkType := pcapHeaderParams(interfaces)
+
+	var writer *pcapgo.Writer
+	if nanos {
+		writer = pcapgo.NewWriterNanos(w)
+	} else {
+		writer = pcapgo.NewWriter(w)
+	}
+
+	if isNewFile {
+		if err := writer.WriteFileHeader(snapLen, linkType); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pcapWriter{writer}, nil
+}
+
+// recordSize returns the number of bytes of a packet record in a file of the
+// given format (i.e., the record header and the packet data).
+func recordSize(format string, dataLen int) int64 {
+	switch format {
+	case FormatPcapNg:
+		// Enhanced Packet Block: 28-byte header, padded data and 4-byte trailer.
+		return int64(32 + (dataLen+3)/4*4)
+	default:
+		// 16-byte record header and data.
+		return int64(16 + dataLen)
+	}
+}
+
+// newPacketWriter returns a packetWriter for the given output format.
+// The file header is written only if isNewFile is true (pcap), or always as a
+// new section (pcapng). nanos is the resolution of timestamps of pcap files;
+// pcapng files always have nanosecond resolution (if_tsresol = 9).
+func newPacketWriter(w io.Writer, isNewFile bool, format string, nanos bool, interfaces []captureInterface) (packetWriter, error) {
+	switch format {
+	case FormatPcapNg:
+		return newPcapNgWriter(w, interfaces)
+	default:
+		return newPcapWriter(w, isNewFile, nanos, interfaces)
+	}
+}
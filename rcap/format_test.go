@@ -0,0 +1,167 @@
+package rcap
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// make interfaces with the given linktypes.
+func makeInterfaces(linkTypes ...layers.LinkType) []captureInterface {
+	var interfaces []captureInterface
+	for i, linkType := range linkTypes {
+		device := DeviceConfig{Name: "eth" + strconv.Itoa(i), BpfRules: "ip", SnapLen: uint(65535 - i)}
+		interfaces = append(interfaces, captureInterface{device: device, linkType: linkType})
+	}
+	return interfaces
+}
+
+func TestCheckInterfaces(t *testing.T) {
+	cases := []struct {
+		// in
+		format     string
+		interfaces []captureInterface
+		// out
+		isValid bool
+	}{
+		{FormatPcap, nil, false},
+		{FormatPcap, makeInterfaces(layers.LinkTypeEthernet), true},
+		{FormatPcap, makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeEthernet), true},
+		{FormatPcap, makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL), false},
+		{FormatPcapNg, makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL), true},
+	}
+
+	for _, c := range cases {
+		err := checkInterfaces(c.format, c.interfaces)
+		if c.isValid && err != nil {
+			t.Errorf("nil is expected, but got '%v': format=%v", err, c.format)
+		}
+		if !c.isValid && err == nil {
+			t.Errorf("err is expected, but got 'nil': format=%v", c.format)
+		}
+	}
+}
+
+func TestNewPacketWriterPcap(t *testing.T) {
+	interfaces := makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeEthernet)
+	buf := &bytes.Buffer{}
+
+	// An existing file: no file header is written.
+	if _, err := newPacketWriter(buf, false, FormatPcap, false, interfaces); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("no header is expected, but got %v bytes.", buf.Len())
+	}
+
+	// A new file.
+	w, err := newPacketWriter(buf, true, FormatPcap, false, interfaces)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}
+	w.WritePacket(capinfo, data)
+	w.Flush()
+
+	r, err := pcapgo.NewReader(buf)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("'%v' is expected, but got '%v'.", layers.LinkTypeEthernet, r.LinkType())
+	}
+	if r.Snaplen() != 65535 {
+		t.Errorf("'%v' is expected, but got '%v'.", 65535, r.Snaplen())
+	}
+}
+
+func TestNewPacketWriterPcapNg(t *testing.T) {
+	interfaces := makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL)
+	buf := &bytes.Buffer{}
+
+	w, err := newPacketWriter(buf, true, FormatPcapNg, false, interfaces)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data), InterfaceIndex: 1}
+	if err := w.WritePacket(capinfo, data); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	w.Flush()
+
+	r, err := pcapgo.NewNgReader(buf, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if _, _, err := r.ReadPacketData(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	if r.NInterfaces() != 2 {
+		t.Errorf("2 interfaces are expected, but got %v.", r.NInterfaces())
+	}
+	intf, _ := r.Interface(1)
+	if intf.Name != "eth1" || intf.Filter != "ip" || intf.SnapLength != 65534 || intf.LinkType != layers.LinkTypeLinuxSLL {
+		t.Errorf("unexpected interface: %#v", intf)
+	}
+	if r.SectionInfo().Hardware != hostname() {
+		t.Errorf("'%v' is expected, but got '%v'.", hostname(), r.SectionInfo().Hardware)
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	cases := []struct {
+		// in
+		format  string
+		dataLen int
+		// out
+		size int64
+	}{
+		{FormatPcap, 0, 16},
+		{FormatPcap, 100, 116},
+		{FormatPcapNg, 0, 32},
+		{FormatPcapNg, 100, 132},
+		{FormatPcapNg, 101, 136},
+	}
+
+	for _, c := range cases {
+		if size := recordSize(c.format, c.dataLen); size != c.size {
+			t.Errorf("'%v' is expected, but got '%v'.", c.size, size)
+		}
+	}
+}
+
+func TestNewPacketWriterPcapNanos(t *testing.T) {
+	interfaces := makeInterfaces(layers.LinkTypeEthernet)
+	buf := &bytes.Buffer{}
+
+	w, err := newPacketWriter(buf, true, FormatPcap, true, interfaces)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	data := []byte("data")
+	ts := time.Unix(86400, 123456789)
+	capinfo := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+	w.WritePacket(capinfo, data)
+
+	r, err := pcapgo.NewReader(buf)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	// NOTE: pcapgo.Reader.Resolution returns the opposite resolution (v1.1.19),
+	// so the timestamp is compared.
+	_, ci, _ := r.ReadPacketData()
+	if !ci.Timestamp.Equal(ts) {
+		t.Errorf("'%v' is expected, but got '%v'.", ts, ci.Timestamp)
+	}
+}
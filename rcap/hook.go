@@ -0,0 +1,144 @@
+package rcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// closedFile is a file closed by a Writer, which is passed to the hook.
+type closedFile struct {
+	name        string
+	start       time.Time // Timestamp of the first packet (or the file is opened).
+	end         time.Time // Timestamp of the last packet (or the file is opened).
+	numPackets  uint
+	numBytes    int64
+	appended    int64     // Size of the file before it is opened (0 unless packets are appended).
+	windowStart time.Time // Time of the file (i.e., rotation time).
+	windowEnd   time.Time // Next rotation time (zero if not rotated by interval).
+}
+
+// hookRunner executes the hook command after files are closed. Commands run in
+// background, so they never block capturing packets.
+type hookRunner struct {
+	command string
+	timeout time.Duration
+	slots   chan struct{} // Limits the number of commands running at once.
+}
+
+// newHookRunner returns a new instance of hookRunner, or nil if no hook
+// command is configured.
+func newHookRunner(c *RcapConfig) *hookRunner {
+	if c.HookCommand == "" {
+		return nil
+	}
+
+	concurrency := c.HookConcurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	return &hookRunner{
+		command: c.HookCommand,
+		timeout: c.HookTimeout,
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// shellQuote quotes the string for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hookValues returns the values of the placeholders for the file.
+func hookValues(f closedFile) map[string]string {
+	return map[string]string{
+		"file":    f.name,
+		"start":   strconv.FormatInt(f.start.Unix(), 10),
+		"end":     strconv.FormatInt(f.end.Unix(), 10),
+		"packets": strconv.FormatUint(uint64(f.numPackets), 10),
+		"bytes":   strconv.FormatInt(f.numBytes, 10),
+	}
+}
+
+// expandHookCommand replaces the placeholders (e.g. {file}) in the command
+// with the shell-quoted values of the file.
+func expandHookCommand(command string, f closedFile) string {
+	var oldnew []string
+	for key, value := range hookValues(f) {
+		oldnew = append(oldnew, "{"+key+"}", shellQuote(value))
+	}
+	return strings.NewReplacer(oldnew...).Replace(command)
+}
+
+// Run executes the hook command for the file in background. The file is kept
+// from the retention policy until the command finishes.
+func (h *hookRunner) Run(f closedFile) {
+	if h == nil {
+		return
+	}
+
+	holdFile(f.name)
+	backgroundJobs.Add(1)
+
+	go func() {
+		defer backgroundJobs.Done()
+		defer releaseFile(f.name)
+
+		h.slots <- struct{}{}
+		defer func() { <-h.slots }()
+
+		h.exec(f)
+	}()
+}
+
+// exec executes the hook command and logs its result.
+func (h *hookRunner) exec(f closedFile) error {
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	command := expandHookCommand(h.command, f)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+
+	// Kill the whole process group on timeout, including children of the
+	// shell which may keep the output open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	// The values are also available as environment variables (e.g. RCAP_FILE).
+	cmd.Env = os.Environ()
+	for key, value := range hookValues(f) {
+		cmd.Env = append(cmd.Env, "RCAP_"+strings.ToUpper(key)+"="+value)
+	}
+
+	startTime := time.Now()
+	output, err := cmd.CombinedOutput()
+	elapsed := time.Since(startTime)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timeout (%v)", h.timeout)
+	}
+
+	if err != nil {
+		slog.Error("hook failed", "file", f.name, "exitCode", cmd.ProcessState.ExitCode(),
+			"elapsed", elapsed.String(), "error", err, "output", strings.TrimSpace(string(output)))
+		return err
+	}
+
+	slog.Info("hook done", "file", f.name, "exitCode", 0, "elapsed", elapsed.String())
+	return nil
+}
@@ -0,0 +1,130 @@
+package rcap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeClosedFile() closedFile {
+	return closedFile{
+		name:       "dump/it's a file.pcap",
+		start:      time.Unix(86400, 0),
+		end:        time.Unix(86459, 0),
+		numPackets: 10,
+		numBytes:   1024,
+	}
+}
+
+func TestExpandHookCommand(t *testing.T) {
+	cases := []struct {
+		command  string
+		expected string
+	}{
+		{"echo {file}", `echo 'dump/it'\''s a file.pcap'`},
+		{"echo {start} {end}", "echo '86400' '86459'"},
+		{"echo {packets} {bytes}", "echo '10' '1024'"},
+		{"echo {unknown}", "echo {unknown}"},
+	}
+
+	for _, c := range cases {
+		got := expandHookCommand(c.command, makeClosedFile())
+		if got != c.expected {
+			t.Errorf("'%v' is expected, but got '%v'.", c.expected, got)
+		}
+	}
+}
+
+func TestHookRunnerExec(t *testing.T) {
+	tempDir := t.TempDir()
+	output := filepath.Join(tempDir, "output")
+
+	c := makeConfig()
+	c.Rcap.HookCommand = "echo {file} {start} {end} {packets} {bytes} $RCAP_PACKETS > " + output
+	h := newHookRunner(&c.Rcap)
+
+	if err := h.exec(makeClosedFile()); err != nil {
+		t.Fatalf("no error is expected, but got '%v'.", err)
+	}
+
+	data, _ := os.ReadFile(output)
+	expected := "dump/it's a file.pcap 86400 86459 10 1024 10"
+	if got := strings.TrimSpace(string(data)); got != expected {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+
+	// Exit code.
+	c.Rcap.HookCommand = "exit 3"
+	h = newHookRunner(&c.Rcap)
+	if err := h.exec(makeClosedFile()); err == nil {
+		t.Errorf("error is expected, but got nil.")
+	}
+
+	// Timeout.
+	c.Rcap.HookCommand = "sleep 10"
+	c.Rcap.HookTimeout = 100 * time.Millisecond
+	h = newHookRunner(&c.Rcap)
+
+	startTime := time.Now()
+	if err := h.exec(makeClosedFile()); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("timeout error is expected, but got '%v'.", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 5*time.Second {
+		t.Errorf("the command is expected to be killed, but it took %v.", elapsed)
+	}
+}
+
+func TestHookRunnerRun(t *testing.T) {
+	c := makeConfig()
+	if h := newHookRunner(&c.Rcap); h != nil {
+		t.Errorf("nil is expected, but got '%v'.", h)
+	}
+
+	tempDir := t.TempDir()
+	c.Rcap.HookCommand = "sleep 0.2; touch " + filepath.Join(tempDir, "$RCAP_PACKETS")
+	c.Rcap.HookConcurrency = 2
+	h := newHookRunner(&c.Rcap)
+
+	// Run never blocks even if the commands are waiting for slots.
+	startTime := time.Now()
+	for i := uint(0); i < 4; i++ {
+		f := makeClosedFile()
+		f.numPackets = i
+		h.Run(f)
+	}
+	if elapsed := time.Since(startTime); elapsed > 100*time.Millisecond {
+		t.Errorf("Run is expected not to block, but it took %v.", elapsed)
+	}
+
+	// Check the number of commands running at once.
+	var maxRunning int32
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := int32(len(h.slots)); n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	backgroundJobs.Wait()
+	close(done)
+
+	if n := atomic.LoadInt32(&maxRunning); n > 2 {
+		t.Errorf("at most 2 commands are expected to run at once, but got %v.", n)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*"))
+	if numFiles := len(files); numFiles != 4 {
+		t.Errorf("4 files are expected, but got %v file(s).", numFiles)
+	}
+}
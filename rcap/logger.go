@@ -0,0 +1,122 @@
+package rcap
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	// LogFormatText writes logs in the logfmt-like text format (key=value).
+	LogFormatText = "text"
+	// LogFormatJSON writes logs as JSON lines.
+	LogFormatJSON = "json"
+)
+
+// logOutput is the io.Writer of all loggers set by SetupLogger, which writes
+// logs to the log file or stderr. The file is switched (e.g. reopened after it
+// is rotated by logrotate) under the lock, and the previous file is closed
+// after that, so loggers held by other goroutines never write to a closed
+// file.
+type logOutput struct {
+	mu   sync.Mutex
+	name string   // Name of the log file ("" for stderr).
+	file *os.File // nil for stderr.
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.file == nil {
+		return os.Stderr.Write(p)
+	}
+	return o.file.Write(p)
+}
+
+// Switch opens the file in append mode (or uses stderr if name is empty) and
+// writes logs to it. The previous file is closed after the switch. If the file
+// cannot be opened, the current one is kept.
+func (o *logOutput) Switch(name string) error {
+	var file *os.File
+	if name != "" {
+		var err error
+		if file, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+
+	o.mu.Lock()
+	old := o.file
+	o.name = name
+	o.file = file
+	o.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Reopen closes the current file and opens the file with the same name. It
+// does nothing if logs are written to stderr.
+func (o *logOutput) Reopen() error {
+	o.mu.Lock()
+	name := o.name
+	o.mu.Unlock()
+
+	if name == "" {
+		return nil
+	}
+	return o.Switch(name)
+}
+
+var (
+	// logOut is shared by the loggers set by SetupLogger.
+	logOut    = &logOutput{}
+	logFileMu sync.Mutex // Serializes SetupLogger and ReopenLogFile.
+)
+
+// parseLogLevel returns the slog.Level of the level name (e.g. "info").
+func parseLogLevel(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// newLogHandler returns a slog.Handler which writes logs to w in the format.
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// SetupLogger sets the default logger according to the config (LogFormat,
+// LogLevel and LogFile). Logs written by the log package are also passed to
+// the logger. The previous log file (if any) is closed after the new one is
+// used, and loggers made before also write to the new one.
+func SetupLogger(r *RcapConfig) error {
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+
+	if err := logOut.Switch(r.LogFile); err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(logOut, r.LogFormat, parseLogLevel(r.LogLevel))))
+	return nil
+}
+
+// ReopenLogFile reopens the log file set by SetupLogger. It does nothing if
+// logs are written to stderr.
+func ReopenLogFile() error {
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+
+	return logOut.Reopen()
+}
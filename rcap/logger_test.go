@@ -0,0 +1,130 @@
+package rcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func restoreLogger(t *testing.T) {
+	t.Cleanup(func() {
+		SetupLogger(&makeConfig().Rcap)
+	})
+}
+
+func TestParseLogLevel(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"error", slog.LevelError},
+		{"unknown", slog.LevelInfo},
+	}
+
+	for _, c := range cases {
+		if got := parseLogLevel(c.name); got != c.expected {
+			t.Errorf("'%v' is expected, but got '%v'.", c.expected, got)
+		}
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := slog.New(newLogHandler(&buf, LogFormatJSON, slog.LevelWarn))
+	logger.Info("ignored", "file", "test.pcap")
+	logger.Warn("written", "file", "test.pcap", "packets", 10)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("1 line is expected, but got %v line(s).", len(lines))
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("JSON is expected, but got '%v' (%v).", lines[0], err)
+	}
+	for key, expected := range map[string]interface{}{"level": "WARN", "msg": "written", "file": "test.pcap", "packets": 10.0} {
+		if record[key] != expected {
+			t.Errorf("'%v' is expected, but got '%v'.", expected, record[key])
+		}
+	}
+	if _, ok := record["time"]; !ok {
+		t.Errorf("time is expected, but not found.")
+	}
+
+	buf.Reset()
+	logger = slog.New(newLogHandler(&buf, LogFormatText, slog.LevelInfo))
+	logger.Info("written", "file", "test.pcap")
+
+	if got := buf.String(); !strings.Contains(got, "level=INFO msg=written file=test.pcap") {
+		t.Errorf("a text record is expected, but got '%v'.", got)
+	}
+}
+
+func TestSetupLoggerAndReopen(t *testing.T) {
+	restoreLogger(t)
+
+	tempDir := t.TempDir()
+	logFile := filepath.Join(tempDir, "rcap.log")
+
+	c := makeConfig()
+	c.Rcap.LogFile = logFile
+	c.Rcap.LogFormat = LogFormatJSON
+	if err := SetupLogger(&c.Rcap); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	// A logger held by another goroutine (e.g. a background job).
+	held := slog.Default()
+
+	slog.Info("before rotation")
+
+	// Rotate the log file like logrotate.
+	rotated := logFile + ".1"
+	if err := os.Rename(logFile, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenLogFile(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	slog.Info("after rotation")
+
+	data, _ := os.ReadFile(rotated)
+	if got := string(data); !strings.Contains(got, `"msg":"before rotation"`) || strings.Contains(got, "after rotation") {
+		t.Errorf("only the record before rotation is expected, but got '%v'.", got)
+	}
+
+	data, _ = os.ReadFile(logFile)
+	if got := string(data); !strings.Contains(got, `"msg":"after rotation"`) {
+		t.Errorf("the record after rotation is expected, but got '%v'.", got)
+	}
+
+	// The held logger writes to the new file after the logger is set up again
+	// (the previous file is closed).
+	otherFile := filepath.Join(tempDir, "other.log")
+	c.Rcap.LogFile = otherFile
+	if err := SetupLogger(&c.Rcap); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	held.Info("held logger")
+
+	data, _ = os.ReadFile(otherFile)
+	if got := string(data); !strings.Contains(got, "held logger") {
+		t.Errorf("the record of the held logger is expected, but got '%v'.", got)
+	}
+
+	// Invalid log file.
+	c.Rcap.LogFile = filepath.Join(tempDir, "no-such-dir", "rcap.log")
+	if err := SetupLogger(&c.Rcap); err == nil {
+		t.Errorf("error is expected, but got nil.")
+	}
+}
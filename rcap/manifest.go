@@ -0,0 +1,233 @@
+package rcap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ManifestSuffix is appended to the name of a closed file to make the name of
+// its manifest (e.g. traffic.pcap.json).
+const ManifestSuffix = ".json"
+
+// Version is the version of rcap written to manifests, which is set by the
+// main package.
+var Version = "(unset)"
+
+// manifestDevice is a device whose packets are written to the file.
+type manifestDevice struct {
+	Name     string `json:"name"`
+	LinkType string `json:"linkType"`
+	BpfRules string `json:"bpfRules"`
+	SnapLen  uint   `json:"snapLen"`
+}
+
+// manifest is the metadata of a closed file, which is written to a JSON
+// sidecar file and the index for chain-of-custody. SHA256 and Bytes are of the
+// whole file, while the packets and their timestamps are of the session which
+// closed the file. If packets are appended to an existing file (FileAppend),
+// Appended is true and SessionBytes is the bytes written in the session.
+type manifest struct {
+	File         string           `json:"file"`
+	SHA256       string           `json:"sha256"`
+	Bytes        int64            `json:"bytes"`
+	SessionBytes int64            `json:"sessionBytes"`
+	Appended     bool             `json:"appended"`
+	Packets      uint             `json:"packets"`
+	FirstPacket  *time.Time       `json:"firstPacket,omitempty"` // nil if no packets are written.
+	LastPacket   *time.Time       `json:"lastPacket,omitempty"`  // nil if no packets are written.
+	WindowStart  time.Time        `json:"windowStart"`           // Time of the file (i.e., rotation time).
+	WindowEnd    *time.Time       `json:"windowEnd,omitempty"`   // Next rotation time (nil if not rotated by interval).
+	Devices      []manifestDevice `json:"devices"`
+	Format       string           `json:"format"`
+	Sampling     float64          `json:"sampling"`
+	Hostname     string           `json:"hostname"`
+	Version      string           `json:"version"`
+}
+
+// manifestWriter writes manifests of files closed by a Writer.
+type manifestWriter struct {
+	sidecar  bool
+	index    *manifestIndex // nil if no index is maintained.
+	devices  []manifestDevice
+	format   string
+	sampling float64 // Effective sampling rate of the Writer.
+}
+
+// newManifestWriter returns a new instance of manifestWriter for the files of
+// the interfaces, or nil if no manifests are configured.
+func newManifestWriter(c *RcapConfig, interfaces []captureInterface, sampling float64, index *manifestIndex) *manifestWriter {
+	if !c.Manifest && index == nil {
+		return nil
+	}
+
+	m := &manifestWriter{
+		sidecar:  c.Manifest,
+		index:    index,
+		format:   c.OutputFormat,
+		sampling: sampling,
+	}
+
+	for _, intf := range interfaces {
+		m.devices = append(m.devices, manifestDevice{
+			Name:     intf.device.Name,
+			LinkType: intf.linkType.String(),
+			BpfRules: intf.device.BpfRules,
+			SnapLen:  intf.device.SnapLen,
+		})
+	}
+
+	return m
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of the file.
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// makeManifest returns the manifest of the closed file.
+func (m *manifestWriter) makeManifest(f closedFile) (*manifest, error) {
+	sum, err := fileSHA256(f.name)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &manifest{
+		File:         f.name,
+		SHA256:       sum,
+		Bytes:        f.numBytes,
+		SessionBytes: f.numBytes - f.appended,
+		Appended:     f.appended > 0,
+		Packets:      f.numPackets,
+		WindowStart:  f.windowStart,
+		Devices:      m.devices,
+		Format:       m.format,
+		Sampling:     m.sampling,
+		Hostname:     hostname(),
+		Version:      Version,
+	}
+
+	if f.numPackets > 0 {
+		mf.FirstPacket = &f.start
+		mf.LastPacket = &f.end
+	}
+	if !f.windowEnd.IsZero() {
+		mf.WindowEnd = &f.windowEnd
+	}
+
+	return mf, nil
+}
+
+// Write writes the manifest of the closed file to the sidecar file and the
+// index. Errors are logged because the file itself has been written.
+func (m *manifestWriter) Write(f closedFile) {
+	if m == nil {
+		return
+	}
+
+	mf, err := m.makeManifest(f)
+	if err != nil {
+		slog.Error("failed to make the manifest", "file", f.name, "error", err)
+		return
+	}
+
+	if m.sidecar {
+		if err := writeManifestFile(f.name+ManifestSuffix, mf); err != nil {
+			slog.Error("failed to write the manifest", "file", f.name+ManifestSuffix, "error", err)
+		}
+	}
+
+	if m.index != nil {
+		if err := m.index.add(mf); err != nil {
+			slog.Error("failed to add the manifest to the index", "file", m.index.path, "error", err)
+		}
+	}
+}
+
+// writeManifestFile writes the manifest to the file. The file is replaced
+// atomically so that it is never read partially.
+func writeManifestFile(path string, mf *manifest) error {
+	data, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// manifestIndex is a JSON Lines file which lists the manifests of all closed
+// files. It is shared by the Writers.
+type manifestIndex struct {
+	mu   sync.Mutex
+	path string
+}
+
+var (
+	// manifestIndexes holds the index per path, which is kept across reloads
+	// so that lines added by background jobs are never interleaved.
+	manifestIndexes   = make(map[string]*manifestIndex)
+	manifestIndexesMu sync.Mutex
+)
+
+// newManifestIndex returns the instance of manifestIndex of the path, or nil
+// if no index is configured.
+func newManifestIndex(c *RcapConfig) *manifestIndex {
+	if c.ManifestIndex == "" {
+		return nil
+	}
+
+	manifestIndexesMu.Lock()
+	defer manifestIndexesMu.Unlock()
+
+	index, ok := manifestIndexes[c.ManifestIndex]
+	if !ok {
+		index = &manifestIndex{path: c.ManifestIndex}
+		manifestIndexes[c.ManifestIndex] = index
+	}
+	return index
+}
+
+// add appends the manifest to the index as a line.
+func (i *manifestIndex) add(mf *manifest) error {
+	data, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(i.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
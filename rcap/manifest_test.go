@@ -0,0 +1,165 @@
+package rcap
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestFileSHA256(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pcap")
+	os.WriteFile(filename, []byte("abc"), 0644)
+
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got, err := fileSHA256(filename); err != nil || got != expected {
+		t.Errorf("'%v' is expected, but got '%v' (%v).", expected, got, err)
+	}
+
+	if _, err := fileSHA256(filename + ".notfound"); err == nil {
+		t.Error("err is expected, but got nil.")
+	}
+}
+
+func TestNewManifestWriter(t *testing.T) {
+	c := makeConfig()
+	interfaces := []captureInterface{{device: DeviceConfig{Name: "eth0", BpfRules: "tcp", SnapLen: 128}, linkType: layers.LinkTypeEthernet}}
+
+	if m := newManifestWriter(&c.Rcap, interfaces, 1.0, nil); m != nil {
+		t.Errorf("nil is expected, but got '%+v'.", m)
+	}
+
+	c.Rcap.Manifest = true
+	m := newManifestWriter(&c.Rcap, interfaces, 0.5, nil)
+	expected := manifestDevice{Name: "eth0", LinkType: "Ethernet", BpfRules: "tcp", SnapLen: 128}
+	if m == nil || len(m.devices) != 1 || m.devices[0] != expected || m.sampling != 0.5 {
+		t.Errorf("'%+v' is expected, but got '%+v'.", expected, m)
+	}
+}
+
+func TestManifestWriterWrite(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := filepath.Join(tempDir, "traffic.pcap")
+	os.WriteFile(filename, []byte("abc"), 0644)
+
+	c := makeConfig()
+	c.Rcap.Manifest = true
+	c.Rcap.ManifestIndex = filepath.Join(tempDir, "index", "captures.jsonl")
+	c.Rcap.SnapLen = 65535
+	m := newManifestWriter(&c.Rcap, []captureInterface{{device: DeviceConfig{Name: "eth0"}, linkType: layers.LinkTypeEthernet}}, 1.0, newManifestIndex(&c.Rcap))
+
+	f := closedFile{
+		name:        filename,
+		start:       time.Unix(100, 0).UTC(),
+		end:         time.Unix(110, 0).UTC(),
+		numPackets:  2,
+		numBytes:    3,
+		appended:    1,
+		windowStart: time.Unix(60, 0).UTC(),
+		windowEnd:   time.Unix(120, 0).UTC(),
+	}
+	m.Write(f)
+
+	// The empty file has no packets nor the rotation window.
+	f.name = filepath.Join(tempDir, "empty.pcap")
+	f.numPackets = 0
+	f.windowEnd = time.Time{}
+	os.WriteFile(f.name, nil, 0644)
+	m.Write(f)
+
+	data, err := os.ReadFile(filename + ManifestSuffix)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	var got manifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if got.File != filename || got.Packets != 2 || got.Bytes != 3 || got.Version != Version {
+		t.Errorf("the manifest of '%v' is expected, but got '%+v'.", filename, got)
+	}
+	if !got.Appended || got.SessionBytes != 2 {
+		t.Errorf("2 bytes appended are expected, but got '%+v'.", got)
+	}
+	if got.SHA256 != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("SHA-256 of 'abc' is expected, but got '%v'.", got.SHA256)
+	}
+	if got.FirstPacket == nil || got.FirstPacket.Unix() != 100 || got.WindowEnd == nil || got.WindowEnd.Unix() != 120 {
+		t.Errorf("the timestamps of the file are expected, but got '%+v'.", got)
+	}
+	if len(got.Devices) != 1 || got.Devices[0].Name != "eth0" {
+		t.Errorf("'eth0' is expected, but got '%+v'.", got.Devices)
+	}
+
+	// The index has a line per file.
+	index, err := os.Open(c.Rcap.ManifestIndex)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	defer index.Close()
+
+	var lines []manifest
+	for scanner := bufio.NewScanner(index); scanner.Scan(); {
+		var line manifest
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[1].File != f.name || lines[1].FirstPacket != nil || lines[1].WindowEnd != nil {
+		t.Errorf("2 lines are expected, but got '%+v'.", lines)
+	}
+
+	// Nothing is written for a missing file.
+	m.Write(closedFile{name: filepath.Join(tempDir, "notfound.pcap")})
+	if FileExists(filepath.Join(tempDir, "notfound.pcap"+ManifestSuffix)) {
+		t.Error("no manifest is expected for a missing file.")
+	}
+}
+
+func TestNewManifestIndex(t *testing.T) {
+	c := makeConfig()
+	if index := newManifestIndex(&c.Rcap); index != nil {
+		t.Errorf("nil is expected, but got '%+v'.", index)
+	}
+
+	// The same index is returned for the same path (e.g. after reloading).
+	c.Rcap.ManifestIndex = filepath.Join(t.TempDir(), "captures.jsonl")
+	index := newManifestIndex(&c.Rcap)
+	if index == nil || newManifestIndex(&c.Rcap) != index {
+		t.Errorf("the same index is expected.")
+	}
+}
+
+func TestRunnerWriteManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Manifest = true
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	if err := r.setupWriters(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	writer := r.sinks[0].writers[0]
+	writer.Update(86400)
+	data := []byte("data")
+	writer.WritePacket(gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}, data)
+
+	r.Close()
+	backgroundJobs.Wait()
+
+	expected := filepath.Join(tempDir, "traffic-19700102-000000.pcap"+ManifestSuffix)
+	if !FileExists(expected) {
+		t.Errorf("'%v' is expected to exist.", expected)
+	}
+}
@@ -0,0 +1,118 @@
+package rcap
+
+import (
+	"container/heap"
+	"math"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// packet is a packet (or an error on reading) captured on a device.
+type packet struct {
+	index   int // Index of the device (Reader).
+	data    []byte
+	capinfo gopacket.CaptureInfo
+	err     error
+}
+
+// packetHeap is a min-heap of packets ordered by their timestamps.
+type packetHeap []*packet
+
+func (h packetHeap) Len() int { return len(h) }
+
+func (h packetHeap) Less(i, j int) bool {
+	return h[i].capinfo.Timestamp.Before(h[j].capinfo.Timestamp)
+}
+
+func (h packetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *packetHeap) Push(x interface{}) { *h = append(*h, x.(*packet)) }
+
+func (h *packetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return p
+}
+
+// endOfTime is later than any timestamps of packets.
+var endOfTime = time.Unix(math.MaxInt32, 0)
+
+// packetMerger merges packets captured on multiple devices in timestamp order.
+//
+// The merger keeps a watermark per device, which is the time no earlier
+// packets are expected to come from the device. A packet is released only
+// after the watermarks of all devices pass its timestamp. The watermark of a
+// device moves to its latest packet, to the current time when reading from the
+// device times out (i.e., the device is idle), and to the end of time when the
+// device reaches its end.
+type packetMerger struct {
+	watermarks []time.Time
+	queue      packetHeap
+}
+
+// newPacketMerger returns a new instance of packetMerger for numDevices.
+func newPacketMerger(numDevices int) *packetMerger {
+	return &packetMerger{
+		watermarks: make([]time.Time, numDevices),
+	}
+}
+
+// Push updates the watermark of the device and queues the packet if it is not
+// an error.
+func (m *packetMerger) Push(p *packet, now time.Time) {
+	var mark time.Time
+
+	switch {
+	case p.err == nil:
+		mark = p.capinfo.Timestamp
+		heap.Push(&m.queue, p)
+	case isTimeout(p.err):
+		mark = now
+	default:
+		mark = endOfTime
+	}
+
+	if mark.After(m.watermarks[p.index]) {
+		m.watermarks[p.index] = mark
+	}
+}
+
+// Pop returns the earliest packet which is ready to be written, or nil if
+// there is no such packet.
+func (m *packetMerger) Pop() *packet {
+	if m.queue.Len() == 0 {
+		return nil
+	}
+
+	low := m.watermarks[0]
+	for _, mark := range m.watermarks[1:] {
+		if mark.Before(low) {
+			low = mark
+		}
+	}
+
+	if m.queue[0].capinfo.Timestamp.After(low) {
+		return nil
+	}
+
+	return heap.Pop(&m.queue).(*packet)
+}
+
+// Drain returns all queued packets in timestamp order regardless of the
+// watermarks.
+func (m *packetMerger) Drain() []*packet {
+	var packets []*packet
+	for m.queue.Len() > 0 {
+		packets = append(packets, heap.Pop(&m.queue).(*packet))
+	}
+	return packets
+}
+
+// Len returns the number of queued packets.
+func (m *packetMerger) Len() int {
+	return m.queue.Len()
+}
@@ -0,0 +1,78 @@
+package rcap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// make packet captured at ts on the device.
+func makePacket(index int, ts int64) *packet {
+	return &packet{index: index, capinfo: gopacket.CaptureInfo{Timestamp: time.Unix(ts, 0)}}
+}
+
+func TestPacketMergerOrder(t *testing.T) {
+	m := newPacketMerger(2)
+	now := time.Unix(100, 0)
+
+	// Packets of device 0 are held until device 1 catches up.
+	m.Push(makePacket(0, 10), now)
+	m.Push(makePacket(0, 30), now)
+	if p := m.Pop(); p != nil {
+		t.Errorf("nil is expected, but got '%v'.", p.capinfo.Timestamp)
+	}
+
+	m.Push(makePacket(1, 20), now)
+
+	expected := []int64{10, 20}
+	for _, ts := range expected {
+		p := m.Pop()
+		if p == nil {
+			t.Fatalf("a packet at '%v' is expected, but got nil.", ts)
+		}
+		if p.capinfo.Timestamp.Unix() != ts {
+			t.Errorf("'%v' is expected, but got '%v'.", ts, p.capinfo.Timestamp.Unix())
+		}
+	}
+
+	if p := m.Pop(); p != nil {
+		t.Errorf("nil is expected, but got '%v'.", p.capinfo.Timestamp)
+	}
+	if m.Len() != 1 {
+		t.Errorf("1 packet is expected, but got %v.", m.Len())
+	}
+}
+
+func TestPacketMergerTimeout(t *testing.T) {
+	m := newPacketMerger(2)
+
+	m.Push(makePacket(0, 10), time.Unix(10, 0))
+	if p := m.Pop(); p != nil {
+		t.Errorf("nil is expected, but got '%v'.", p.capinfo.Timestamp)
+	}
+
+	// Device 1 is idle.
+	m.Push(&packet{index: 1, err: pcap.NextErrorTimeoutExpired}, time.Unix(11, 0))
+	if p := m.Pop(); p == nil {
+		t.Error("a packet is expected, but got nil.")
+	}
+}
+
+func TestPacketMergerDrain(t *testing.T) {
+	m := newPacketMerger(2)
+	m.Push(makePacket(0, 30), time.Unix(0, 0))
+	m.Push(makePacket(0, 10), time.Unix(0, 0))
+
+	packets := m.Drain()
+	if len(packets) != 2 {
+		t.Fatalf("2 packets are expected, but got %v.", len(packets))
+	}
+	if packets[0].capinfo.Timestamp.Unix() != 10 || packets[1].capinfo.Timestamp.Unix() != 30 {
+		t.Errorf("packets are not sorted: %v, %v", packets[0].capinfo.Timestamp, packets[1].capinfo.Timestamp)
+	}
+	if m.Len() != 0 {
+		t.Errorf("0 packets are expected, but got %v.", m.Len())
+	}
+}
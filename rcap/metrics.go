@@ -0,0 +1,281 @@
+package rcap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricsPath is the path of the HTTP endpoint to expose metrics.
+	MetricsPath = "/metrics"
+)
+
+// deviceMetrics holds counters of a device.
+type deviceMetrics struct {
+	packetsRead      uint64
+	queueDropped     uint64
+	pcapReceived     uint64
+	pcapDropped      uint64
+	pcapIfDropped    uint64
+	pcapStatsUpdated bool
+}
+
+// captureMetrics holds counters of the capture, which are exposed in the
+// Prometheus text format. The counters are kept over reloading.
+type captureMetrics struct {
+	mu sync.Mutex
+
+	devices                  map[string]*deviceMetrics
+	packetsWritten           uint64
+	bytesWritten             uint64
+	packetsSampled           uint64
+	packetsDroppedBySampling uint64
+	packetsDroppedByLimit    uint64
+	queueLength              int
+	rotations                uint64
+	triggers                 uint64
+	writeErrors              uint64
+	currentFiles             map[*Writer]string
+}
+
+var (
+	// metrics is the counters of this process.
+	metrics = newCaptureMetrics()
+)
+
+// newCaptureMetrics returns a new instance of captureMetrics.
+func newCaptureMetrics() *captureMetrics {
+	return &captureMetrics{
+		devices:      make(map[string]*deviceMetrics),
+		currentFiles: make(map[*Writer]string),
+	}
+}
+
+// device returns the counters of the device. m.mu must be held.
+func (m *captureMetrics) device(name string) *deviceMetrics {
+	d, ok := m.devices[name]
+	if !ok {
+		d = &deviceMetrics{}
+		m.devices[name] = d
+	}
+	return d
+}
+
+func (m *captureMetrics) addPacketRead(device string) {
+	m.mu.Lock()
+	m.device(device).packetsRead++
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addQueueDropped(device string) {
+	m.mu.Lock()
+	m.device(device).queueDropped++
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) setQueueLength(length int) {
+	m.mu.Lock()
+	m.queueLength = length
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addPacketWritten(size int64) {
+	m.mu.Lock()
+	m.packetsWritten++
+	m.bytesWritten += uint64(size)
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addSampling(sample bool) {
+	m.mu.Lock()
+	if sample {
+		m.packetsSampled++
+	} else {
+		m.packetsDroppedBySampling++
+	}
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addRateLimited() {
+	m.mu.Lock()
+	m.packetsDroppedByLimit++
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addRotation() {
+	m.mu.Lock()
+	m.rotations++
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addTrigger() {
+	m.mu.Lock()
+	m.triggers++
+	m.mu.Unlock()
+}
+
+func (m *captureMetrics) addWriteError() {
+	m.mu.Lock()
+	m.writeErrors++
+	m.mu.Unlock()
+}
+
+// setCurrentFile sets the file the writer writes to. An empty name means that
+// the writer has no file.
+func (m *captureMetrics) setCurrentFile(w *Writer, name string) {
+	m.mu.Lock()
+	if name == "" {
+		delete(m.currentFiles, w)
+	} else {
+		m.currentFiles[w] = name
+	}
+	m.mu.Unlock()
+}
+
+// setPcapStats sets the statistics of libpcap of the device. The counters of
+// libpcap are reset when the device is reopened (e.g. on reloading), so they
+// are exposed as gauges.
+func (m *captureMetrics) setPcapStats(device string, received, dropped, ifDropped uint64) {
+	m.mu.Lock()
+	d := m.device(device)
+	d.pcapReceived = received
+	d.pcapDropped = dropped
+	d.pcapIfDropped = ifDropped
+	d.pcapStatsUpdated = true
+	m.mu.Unlock()
+}
+
+// escapeLabelValue escapes a label value in the Prometheus text format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// WriteTo writes the metrics in the Prometheus text format (version 0.0.4).
+func (m *captureMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	}
+
+	var devices []string
+	for name := range m.devices {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+
+	perDevice := func(name, typ, help string, value func(d *deviceMetrics) (uint64, bool)) {
+		header(name, typ, help)
+		for _, device := range devices {
+			if v, ok := value(m.devices[device]); ok {
+				fmt.Fprintf(&b, "%v{device=\"%v\"} %v\n", name, escapeLabelValue(device), v)
+			}
+		}
+	}
+
+	perDevice("rcap_packets_read_total", "counter", "Number of packets read from the device.",
+		func(d *deviceMetrics) (uint64, bool) { return d.packetsRead, true })
+	perDevice("rcap_packets_dropped_by_queue_total", "counter", "Number of packets dropped because the queue to the writers is full.",
+		func(d *deviceMetrics) (uint64, bool) { return d.queueDropped, true })
+	perDevice("rcap_pcap_received_packets", "gauge", "Number of packets received by libpcap since the device was opened.",
+		func(d *deviceMetrics) (uint64, bool) { return d.pcapReceived, d.pcapStatsUpdated })
+	perDevice("rcap_pcap_dropped_packets", "gauge", "Number of packets dropped by the kernel since the device was opened.",
+		func(d *deviceMetrics) (uint64, bool) { return d.pcapDropped, d.pcapStatsUpdated })
+	perDevice("rcap_pcap_if_dropped_packets", "gauge", "Number of packets dropped by the interface since the device was opened.",
+		func(d *deviceMetrics) (uint64, bool) { return d.pcapIfDropped, d.pcapStatsUpdated })
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"rcap_packets_written_total", "Number of packets written to files.", m.packetsWritten},
+		{"rcap_bytes_written_total", "Number of bytes of packet records written to files (before compression).", m.bytesWritten},
+		{"rcap_packets_sampled_total", "Number of packets kept by sampling.", m.packetsSampled},
+		{"rcap_packets_dropped_by_sampling_total", "Number of packets dropped by sampling.", m.packetsDroppedBySampling},
+		{"rcap_packets_dropped_by_rate_limit_total", "Number of packets dropped by rate limiting.", m.packetsDroppedByLimit},
+		{"rcap_rotations_total", "Number of rotations of files.", m.rotations},
+		{"rcap_triggers_total", "Number of triggers fired.", m.triggers},
+		{"rcap_write_errors_total", "Number of errors on writing packets.", m.writeErrors},
+	}
+	for _, c := range counters {
+		header(c.name, "counter", c.help)
+		fmt.Fprintf(&b, "%v %v\n", c.name, c.value)
+	}
+
+	header("rcap_queue_length", "gauge", "Number of packets in the queue to the writers.")
+	fmt.Fprintf(&b, "rcap_queue_length %v\n", m.queueLength)
+
+	var files []string
+	for _, name := range m.currentFiles {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	header("rcap_current_file", "gauge", "File currently written (the value is always 1).")
+	for _, name := range files {
+		fmt.Fprintf(&b, "rcap_current_file{file=\"%v\"} 1\n", escapeLabelValue(name))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes the metrics to the response.
+func (m *captureMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// startMetricsServer starts an HTTP server which exposes the metrics on
+// MetricsPath in background, and returns a function to stop it.
+func startMetricsServer(addr string, m *captureMetrics) (func(), error) {
+	return startHTTPServer(addr, MetricsPath, m)
+}
+
+// startHTTPServer starts an HTTP server which serves the handler on the path
+// in background, and returns a function to stop it.
+func startHTTPServer(addr string, path string, handler http.Handler) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Listen here to return an error (e.g. the address is already in use).
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://%v%v", listener.Addr(), path)
+	slog.Info("serve HTTP endpoint", "url", url)
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("failed to serve HTTP endpoint", "url", url, "error", err)
+		}
+	}()
+
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,97 @@
+package rcap
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureMetricsWriteTo(t *testing.T) {
+	m := newCaptureMetrics()
+	w := &Writer{}
+
+	m.addPacketRead("eth0")
+	m.addPacketRead("eth0")
+	m.addPacketRead("eth1")
+	m.addPacketWritten(100)
+	m.addPacketWritten(50)
+	m.addSampling(true)
+	m.addSampling(false)
+	m.addRateLimited()
+	m.addRotation()
+	m.addTrigger()
+	m.addWriteError()
+	m.setCurrentFile(w, `dump/"test".pcap`)
+	m.setPcapStats("eth1", 10, 2, 1)
+	m.addQueueDropped("eth1")
+	m.setQueueLength(3)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	output := b.String()
+
+	lines := []string{
+		`rcap_packets_read_total{device="eth0"} 2`,
+		`rcap_packets_read_total{device="eth1"} 1`,
+		`rcap_pcap_received_packets{device="eth1"} 10`,
+		`rcap_pcap_dropped_packets{device="eth1"} 2`,
+		`rcap_pcap_if_dropped_packets{device="eth1"} 1`,
+		`rcap_packets_dropped_by_queue_total{device="eth0"} 0`,
+		`rcap_packets_dropped_by_queue_total{device="eth1"} 1`,
+		`rcap_queue_length 3`,
+		`rcap_packets_written_total 2`,
+		`rcap_bytes_written_total 150`,
+		`rcap_packets_sampled_total 1`,
+		`rcap_packets_dropped_by_sampling_total 1`,
+		`rcap_packets_dropped_by_rate_limit_total 1`,
+		`rcap_rotations_total 1`,
+		`rcap_triggers_total 1`,
+		`rcap_write_errors_total 1`,
+		`rcap_current_file{file="dump/\"test\".pcap"} 1`,
+		`# TYPE rcap_packets_read_total counter`,
+	}
+	for _, line := range lines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("'%v' is expected in the output, but not found:\n%v", line, output)
+		}
+	}
+
+	// No statistics of libpcap are available for eth0.
+	if strings.Contains(output, `rcap_pcap_dropped_packets{device="eth0"}`) {
+		t.Errorf("no statistics of eth0 are expected, but found:\n%v", output)
+	}
+
+	// The file is removed when the writer is closed.
+	m.setCurrentFile(w, "")
+	b.Reset()
+	m.WriteTo(&b)
+	if strings.Contains(b.String(), "rcap_current_file{") {
+		t.Errorf("no current file is expected, but found:\n%v", b.String())
+	}
+}
+
+func TestCaptureMetricsServeHTTP(t *testing.T) {
+	m := newCaptureMetrics()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("'text/plain' is expected, but got '%v'.", contentType)
+	}
+	if !strings.Contains(rec.Body.String(), "rcap_packets_written_total 0\n") {
+		t.Errorf("'rcap_packets_written_total 0' is expected, but got:\n%v", rec.Body.String())
+	}
+}
+
+func TestStartMetricsServer(t *testing.T) {
+	stop, err := startMetricsServer("127.0.0.1:0", newCaptureMetrics())
+	if err != nil {
+		t.Fatalf("no error is expected, but got '%v'.", err)
+	}
+	stop()
+
+	if _, err := startMetricsServer("invalid-address", newCaptureMetrics()); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
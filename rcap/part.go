@@ -0,0 +1,106 @@
+package rcap
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// PartFilesNone writes files under their final names.
+	PartFilesNone = "none"
+	// PartFilesSuffix writes files under their final names with PartSuffix
+	// (e.g. traffic.pcap.part) until they are closed.
+	PartFilesSuffix = "suffix"
+	// PartFilesDot writes files under their final names prefixed with a dot
+	// (e.g. .traffic.pcap) until they are closed.
+	PartFilesDot = "dot"
+)
+
+// partFileName returns the name of the file in progress for the final name.
+// It returns the final name if PartFiles is "none".
+func partFileName(c *RcapConfig, name string) string {
+	switch c.PartFiles {
+	case PartFilesSuffix:
+		return name + c.PartSuffix
+	case PartFilesDot:
+		return filepath.Join(filepath.Dir(name), "."+filepath.Base(name))
+	default:
+		return name
+	}
+}
+
+// finalFileName returns the final name of the file in progress and true, or
+// false if the name is not of a file in progress.
+func finalFileName(c *RcapConfig, name string) (string, bool) {
+	switch c.PartFiles {
+	case PartFilesSuffix:
+		if strings.HasSuffix(name, c.PartSuffix) {
+			return strings.TrimSuffix(name, c.PartSuffix), true
+		}
+	case PartFilesDot:
+		base := filepath.Base(name)
+		if len(base) > 1 && strings.HasPrefix(base, ".") {
+			return filepath.Join(filepath.Dir(name), base[1:]), true
+		}
+	}
+	return "", false
+}
+
+// finalizeFile renames the file in progress to the final name atomically.
+func finalizeFile(partName string, finalName string) error {
+	if partName == finalName {
+		return nil
+	}
+	return os.Rename(partName, finalName)
+}
+
+// recoverPartFiles renames the files in progress made from the format, which
+// are left by a crash, to their final names. If the final name is already
+// used, the name with the next suffix (e.g. -1) is used instead. It returns
+// the final names of the recovered files.
+func recoverPartFiles(c *RcapConfig, format string) []string {
+	if c.PartFiles == PartFilesNone {
+		return nil
+	}
+
+	pattern := fileFmtPattern(filepath.Clean(format))
+	root := fileFmtRoot(filepath.Clean(format))
+
+	var partNames []string
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable files and directories.
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if finalName, ok := finalFileName(c, path); ok && pattern.MatchString(finalName) {
+			partNames = append(partNames, path)
+		}
+		return nil
+	})
+
+	var recovered []string
+
+	for _, partName := range partNames {
+		baseName, _ := finalFileName(c, partName)
+		finalName := baseName
+		for i := 1; FileExists(finalName); i++ {
+			finalName = suffixedFileName(baseName, i)
+		}
+
+		if err := finalizeFile(partName, finalName); err != nil {
+			slog.Error("failed to recover the file in progress", "file", partName, "error", err)
+			continue
+		}
+		slog.Warn("recover the file in progress", "file", partName, "finalFile", finalName)
+		recovered = append(recovered, finalName)
+	}
+
+	return recovered
+}
@@ -0,0 +1,131 @@
+package rcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestPartFileName(t *testing.T) {
+	cases := []struct {
+		partFiles string
+		name      string
+		expected  string
+	}{
+		{PartFilesNone, "dump/traffic.pcap", "dump/traffic.pcap"},
+		{PartFilesSuffix, "dump/traffic.pcap", "dump/traffic.pcap.part"},
+		{PartFilesDot, "dump/traffic.pcap", "dump/.traffic.pcap"},
+	}
+
+	for _, tc := range cases {
+		c := makeConfig()
+		c.Rcap.PartFiles = tc.partFiles
+
+		got := partFileName(&c.Rcap, tc.name)
+		if got != tc.expected {
+			t.Errorf("%v: '%v' is expected, but got '%v'.", tc.partFiles, tc.expected, got)
+		}
+
+		finalName, ok := finalFileName(&c.Rcap, got)
+		if tc.partFiles == PartFilesNone {
+			if ok {
+				t.Errorf("%v: false is expected, but got true.", tc.partFiles)
+			}
+		} else if !ok || finalName != tc.name {
+			t.Errorf("%v: '%v' is expected, but got '%v'.", tc.partFiles, tc.name, finalName)
+		}
+	}
+
+	// Not a file in progress.
+	c := makeConfig()
+	c.Rcap.PartFiles = PartFilesSuffix
+	if _, ok := finalFileName(&c.Rcap, "dump/traffic.pcap"); ok {
+		t.Error("false is expected, but got true.")
+	}
+}
+
+func TestRecoverPartFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	fileFmt := filepath.Join(tempDir, "%Y%m%d", "traffic-%H%M%S.pcap")
+
+	c := makeConfig()
+	c.Rcap.PartFiles = PartFilesSuffix
+
+	dir := filepath.Join(tempDir, "19700101")
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"traffic-000000.pcap.part", "traffic-000100.pcap.part", "traffic-000100.pcap", "other.pcap.part"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644)
+	}
+
+	recovered := recoverPartFiles(&c.Rcap, fileFmt)
+	if len(recovered) != 2 {
+		t.Errorf("2 files are expected, but got %v file(s).", len(recovered))
+	}
+
+	// The existing file is not overwritten.
+	for _, name := range []string{"traffic-000000.pcap", "traffic-000100.pcap", "traffic-000100-1.pcap", "other.pcap.part"} {
+		if !FileExists(filepath.Join(dir, name)) {
+			t.Errorf("'%v' is expected to exist.", name)
+		}
+	}
+
+	// Nothing is done if PartFiles is "none".
+	c.Rcap.PartFiles = PartFilesNone
+	if recovered := recoverPartFiles(&c.Rcap, fileFmt); len(recovered) != 0 {
+		t.Errorf("no files are expected, but got %v file(s).", len(recovered))
+	}
+}
+
+func TestWriterPartFiles(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.PartFiles = PartFilesDot
+	c.CheckAndFormat()
+
+	finalName := filepath.Join(tempDir, "traffic-19700102-000000.pcap")
+	partName := filepath.Join(tempDir, ".traffic-19700102-000000.pcap")
+
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}
+
+	var closed []closedFile
+
+	for i := 0; i < 2; i++ {
+		w, _ := NewWriter(c, layers.LinkTypeEthernet)
+		w.onClose = func(f closedFile) { closed = append(closed, f) }
+		w.Update(86400)
+		w.WritePacket(capinfo, data)
+
+		// Only the file in progress exists while writing (the existing file
+		// is moved to it to append packets).
+		if !FileExists(partName) || FileExists(finalName) {
+			t.Errorf("only '%v' is expected to exist.", partName)
+		}
+
+		w.Close()
+
+		if FileExists(partName) || !FileExists(finalName) {
+			t.Errorf("only '%v' is expected to exist.", finalName)
+		}
+	}
+
+	if len(closed) != 2 || closed[1].name != finalName {
+		t.Errorf("'%v' is expected, but got '%+v'.", finalName, closed)
+	}
+
+	// The second session appends packets to the file of the first one.
+	if closed[0].appended != 0 || closed[1].appended != 44 {
+		t.Errorf("'0' and '44' are expected, but got '%+v'.", closed)
+	}
+
+	// 24 bytes of the header and 2 packets of 20 bytes.
+	if size := fileSize(finalName, -1); size != 64 {
+		t.Errorf("'64' is expected, but got '%v'.", size)
+	}
+}
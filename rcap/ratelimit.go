@@ -0,0 +1,182 @@
+package rcap
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// rateLimitMaxSources is the max number of sources which have their own
+	// buckets. Packets from other sources share one bucket.
+	rateLimitMaxSources = 65536
+	// rateLimitCleanupInterval is the interval to remove buckets of idle
+	// sources.
+	rateLimitCleanupInterval = 10 * time.Second
+	// rateLimitOtherSource is the key of the bucket shared by packets without
+	// source IP addresses or from sources over rateLimitMaxSources.
+	rateLimitOtherSource = ""
+	// rateLimitMaxPacketSize is the min capacity of buckets of bytes, which is
+	// the max snaplen of libpcap (MAXIMUM_SNAPLEN).
+	rateLimitMaxPacketSize = 262144
+)
+
+// tokenBucket is a token bucket which holds tokens for one second at most.
+type tokenBucket struct {
+	rate     float64 // Tokens added per second.
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket returns a full bucket. The capacity is at least minCapacity
+// so that a large packet can pass.
+func newTokenBucket(rate float64, minCapacity float64, now time.Time) *tokenBucket {
+	capacity := rate
+	if capacity < minCapacity {
+		capacity = minCapacity
+	}
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+// refill adds tokens for the time elapsed since the last refill. Time going
+// backwards (e.g. packets out of order) adds no tokens.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// isFull returns true if the bucket is full at the time (i.e., the source is
+// idle and the bucket can be removed).
+func (b *tokenBucket) isFull(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// rateBuckets is a pair of buckets of packets and bytes (nil if no limit).
+type rateBuckets struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+// allow takes tokens for a packet of the size and returns true if both
+// buckets have enough tokens. No tokens are taken if the packet is limited.
+func (b *rateBuckets) allow(now time.Time, size int) bool {
+	if b.packets != nil {
+		b.packets.refill(now)
+		if b.packets.tokens < 1 {
+			return false
+		}
+	}
+	if b.bytes != nil {
+		b.bytes.refill(now)
+		if b.bytes.tokens < float64(size) {
+			return false
+		}
+	}
+
+	if b.packets != nil {
+		b.packets.tokens--
+	}
+	if b.bytes != nil {
+		b.bytes.tokens -= float64(size)
+	}
+	return true
+}
+
+func (b *rateBuckets) isFull(now time.Time) bool {
+	return (b.packets == nil || b.packets.isFull(now)) && (b.bytes == nil || b.bytes.isFull(now))
+}
+
+// rateLimiter limits packets per second and bytes per second with token
+// buckets, globally or per source IP address.
+type rateLimiter struct {
+	packetsPerSec float64
+	bytesPerSec   float64
+	perSource     bool
+	global        *rateBuckets
+	sources       map[string]*rateBuckets
+	lastCleanup   time.Time
+}
+
+// newRateLimiter returns a new instance of rateLimiter, or nil if no limit is
+// configured.
+func newRateLimiter(c *RcapConfig) *rateLimiter {
+	if c.RateLimitPackets == 0 && c.RateLimitBytes == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		packetsPerSec: c.RateLimitPackets,
+		bytesPerSec:   c.RateLimitBytes,
+		perSource:     c.RateLimitPerSource,
+		sources:       make(map[string]*rateBuckets),
+	}
+}
+
+func (l *rateLimiter) newBuckets(now time.Time) *rateBuckets {
+	b := &rateBuckets{}
+	if l.packetsPerSec > 0 {
+		b.packets = newTokenBucket(l.packetsPerSec, 1, now)
+	}
+	if l.bytesPerSec > 0 {
+		b.bytes = newTokenBucket(l.bytesPerSec, rateLimitMaxPacketSize, now)
+	}
+	return b
+}
+
+// sourceIP returns the source IP address of the packet, or
+// rateLimitOtherSource if the packet has no network layer.
+func sourceIP(data []byte, linkType layers.LinkType) string {
+	p := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if network := p.NetworkLayer(); network != nil {
+		return string(network.NetworkFlow().Src().Raw())
+	}
+	return rateLimitOtherSource
+}
+
+// bucketsOf returns the buckets of the source. Buckets of idle sources are
+// removed periodically to bound the memory (e.g. on spoofed sources).
+func (l *rateLimiter) bucketsOf(source string, now time.Time) *rateBuckets {
+	if b, ok := l.sources[source]; ok {
+		return b
+	}
+
+	if now.Sub(l.lastCleanup) >= rateLimitCleanupInterval {
+		for key, b := range l.sources {
+			if b.isFull(now) {
+				delete(l.sources, key)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	if len(l.sources) >= rateLimitMaxSources {
+		source = rateLimitOtherSource
+		if b, ok := l.sources[source]; ok {
+			return b
+		}
+	}
+
+	b := l.newBuckets(now)
+	l.sources[source] = b
+	return b
+}
+
+// Allow returns true if the packet does not exceed the limits at the time.
+func (l *rateLimiter) Allow(data []byte, linkType layers.LinkType, size int, now time.Time) bool {
+	if !l.perSource {
+		if l.global == nil {
+			l.global = l.newBuckets(now)
+		}
+		return l.global.allow(now, size)
+	}
+
+	return l.bucketsOf(sourceIP(data, linkType), now).allow(now, size)
+}
@@ -0,0 +1,140 @@
+package rcap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(86400, 0)
+	b := &rateBuckets{packets: newTokenBucket(2, 1, now)}
+
+	// The bucket is full at first.
+	for i, expected := range []bool{true, true, false} {
+		if got := b.allow(now, 100); got != expected {
+			t.Errorf("'%v' is expected, but got '%v' (i: %v).", expected, got, i)
+		}
+	}
+
+	// One token is added in 0.5 seconds.
+	if !b.allow(now.Add(500*time.Millisecond), 100) {
+		t.Errorf("'true' is expected, but got 'false'.")
+	}
+	// Time going backwards adds no tokens.
+	if b.allow(now, 100) {
+		t.Errorf("'false' is expected, but got 'true'.")
+	}
+	// Tokens are never more than the capacity.
+	now = now.Add(time.Hour)
+	if !b.isFull(now) {
+		t.Errorf("the bucket is expected to be full.")
+	}
+	if b.packets.tokens != 2 {
+		t.Errorf("'2' is expected, but got '%v'.", b.packets.tokens)
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	c := makeConfig()
+	if l := newRateLimiter(&c.Rcap); l != nil {
+		t.Errorf("nil is expected, but got '%v'.", l)
+	}
+
+	c.Rcap.RateLimitBytes = 1000
+	l := newRateLimiter(&c.Rcap)
+	now := time.Unix(86400, 0)
+
+	// A packet larger than the rate can pass with the full bucket.
+	if !l.Allow(nil, layers.LinkTypeEthernet, 2000, now) {
+		t.Errorf("'true' is expected, but got 'false'.")
+	}
+
+	// The bucket holds rateLimitMaxPacketSize bytes at most.
+	passed := 0
+	for i := 0; i < 1000; i++ {
+		if l.Allow(nil, layers.LinkTypeEthernet, 1000, now) {
+			passed++
+		}
+	}
+	if expected := (rateLimitMaxPacketSize - 2000) / 1000; passed != expected {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, passed)
+	}
+
+	// No tokens are taken from the bucket of packets by limited packets.
+	c.Rcap.RateLimitPackets = 1
+	l = newRateLimiter(&c.Rcap)
+	if !l.Allow(nil, layers.LinkTypeEthernet, rateLimitMaxPacketSize, now) {
+		t.Errorf("'true' is expected, but got 'false'.")
+	}
+	if l.Allow(nil, layers.LinkTypeEthernet, 100, now) {
+		t.Errorf("'false' is expected, but got 'true'.")
+	}
+	if l.global.bytes.tokens != 0 {
+		t.Errorf("'0' is expected, but got '%v'.", l.global.bytes.tokens)
+	}
+}
+
+func TestRateLimiterPerSource(t *testing.T) {
+	c := makeConfig()
+	c.Rcap.RateLimitPackets = 1
+	c.Rcap.RateLimitPerSource = true
+
+	l := newRateLimiter(&c.Rcap)
+	now := time.Unix(86400, 0)
+
+	a := makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80)
+	b := makeTCPPacket(t, "192.0.2.2", 12345, "198.51.100.1", 80)
+
+	cases := []struct {
+		data     []byte
+		expected bool
+	}{
+		{a, true},
+		{a, false},
+		{b, true}, // Another source has its own bucket.
+		{b, false},
+	}
+	for i, c := range cases {
+		if got := l.Allow(c.data, layers.LinkTypeEthernet, len(c.data), now); got != c.expected {
+			t.Errorf("'%v' is expected, but got '%v' (i: %v).", c.expected, got, i)
+		}
+	}
+
+	if len(l.sources) != 2 {
+		t.Errorf("'2' is expected, but got '%v'.", len(l.sources))
+	}
+
+	// Buckets of idle sources are removed.
+	now = now.Add(rateLimitCleanupInterval)
+	c2 := makeTCPPacket(t, "192.0.2.3", 12345, "198.51.100.1", 80)
+	l.Allow(c2, layers.LinkTypeEthernet, len(c2), now)
+	if len(l.sources) != 1 {
+		t.Errorf("'1' is expected, but got '%v'.", len(l.sources))
+	}
+}
+
+func TestRunnerDoRateLimit(t *testing.T) {
+	c := makeConfig()
+	c.Rcap.RateLimitPackets = 1
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.numStatsPackets = 10
+
+	count := 0
+	for i := 0; i < 5; i++ {
+		p := makePacket(0, 86400)
+		if r.doSampling(p.data, layers.LinkTypeEthernet) && r.doRateLimit(p, layers.LinkTypeEthernet) {
+			count++
+		}
+	}
+
+	if count != 1 {
+		t.Errorf("'1' is expected, but got '%v'.", count)
+	}
+	if r.numLimitedPackets != 4 || r.numCapturedPackets != 5 {
+		t.Errorf("'4/5' is expected, but got '%v/%v'.", r.numLimitedPackets, r.numCapturedPackets)
+	}
+}
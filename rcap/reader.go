@@ -1,7 +1,12 @@
 package rcap
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -9,20 +14,96 @@ import (
 	"github.com/google/gopacket/pcap"
 )
 
+const (
+	// TimestampPrecisionMicro truncates timestamps of packets to microseconds.
+	TimestampPrecisionMicro = "micro"
+	// TimestampPrecisionNano keeps timestamps of packets in nanoseconds (if
+	// the device supports).
+	TimestampPrecisionNano = "nano"
+
+	// OfflineDevice is the device name of a Reader which reads packets from
+	// pcap files.
+	OfflineDevice = "file"
+)
+
 type Reader struct {
 	config     *Config
+	device     DeviceConfig
 	handle     *pcap.Handle
-	numPackets uint
+	linkType   layers.LinkType // Linktype of the handle (all files of a file list have the same one).
+	numPackets uint64          // Accessed atomically (ReadPacket runs in a goroutine).
+	offline    bool            // Read packets from pcap files.
+	files      []string        // Pcap files to read after the current one.
+
+	statsRequested int32 // Set to 1 to get the statistics of libpcap before the next read (accessed atomically).
+
+	numQueueDropped uint64 // Packets dropped because the queue is full (accessed atomically).
+
+	mu         sync.Mutex            // Guards device, pendingBpf and snapshot.
+	pendingBpf []pcap.BPFInstruction // Compiled BPF rules installed before the next read (nil if none).
+	snapshot   *statsSnapshot        // Counters at the latest statistics of libpcap (nil if not got yet).
 }
 
-func openAndSetUpReader(config *Config, _pcap string) (*Reader, error) {
+// openLiveHandle opens the device with the capture parameters of the
+// configuration (e.g. buffer size and immediate mode).
+func openLiveHandle(c *RcapConfig, device DeviceConfig) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(int(device.SnapLen)); err != nil {
+		return nil, fmt.Errorf("failed to set snaplen: %w", err)
+	}
+	if err := inactive.SetPromisc(c.Promisc); err != nil {
+		return nil, fmt.Errorf("failed to set promiscuous mode: %w", err)
+	}
+	if err := inactive.SetTimeout(time.Duration(c.ToMs) * time.Millisecond); err != nil {
+		return nil, fmt.Errorf("failed to set timeout: %w", err)
+	}
+	if c.BufferSize > 0 {
+		if err := inactive.SetBufferSize(c.BufferSize); err != nil {
+			return nil, fmt.Errorf("failed to set buffer size: %w", err)
+		}
+	}
+	if c.ImmediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("failed to set immediate mode: %w", err)
+		}
+	}
+	if c.TimestampType != "" {
+		source, err := pcap.TimestampSourceFromString(c.TimestampType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp type: '%v'", c.TimestampType)
+		}
+		if err := inactive.SetTimestampSource(source); err != nil {
+			return nil, fmt.Errorf("failed to set timestamp type: %w", err)
+		}
+	}
+
+	// Activate requests nanosecond precision of timestamps. If it is not
+	// supported, microsecond precision is used.
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate device %v: %w", device.Name, err)
+	}
+
+	if c.TimestampPrecision == TimestampPrecisionNano && handle.Resolution() != gopacket.TimestampResolutionNanosecond {
+		slog.Warn("nanosecond precision is not supported, microsecond precision is used.", "device", device.Name)
+	}
+
+	return handle, nil
+}
+
+func openAndSetUpReader(config *Config, device DeviceConfig, _pcap string) (*Reader, error) {
 	c := &config.Rcap
 
 	var handle *pcap.Handle
 	var err error
 
 	if _pcap == "" {
-		handle, err = pcap.OpenLive(c.Device, int32(c.SnapLen), c.Promisc, time.Duration(c.ToMs)*time.Millisecond)
+		handle, err = openLiveHandle(c, device)
 		if err != nil {
 			return nil, err
 		}
@@ -33,59 +114,336 @@ func openAndSetUpReader(config *Config, _pcap string) (*Reader, error) {
 		}
 	}
 
-	if c.BpfRules != "" {
-		err := handle.SetBPFFilter(c.BpfRules)
+	if device.BpfRules != "" {
+		err := handle.SetBPFFilter(device.BpfRules)
 		if err != nil {
+			handle.Close()
 			return nil, err
 		}
 	}
 
-	log.Printf("open interface: %v (linktype: %v)", c.Device, handle.LinkType())
-	log.Printf("set bpf rule: %v", c.BpfRules)
+	slog.Info("open interface", "device", device.Name, "linktype", handle.LinkType().String(), "bpfRules", device.BpfRules)
 
 	reader := &Reader{
 		config:     config,
+		device:     device,
 		handle:     handle,
+		linkType:   handle.LinkType(),
 		numPackets: 0,
+		offline:    _pcap != "",
 	}
 
 	return reader, nil
 }
 
+// NewFileReader creates a new struct Reader which reads packets from the pcap
+// files in order, applying BpfRules of the configuration. All files must have
+// the same linktype. The snaplen of the Reader is the largest one of the files.
+func NewFileReader(config *Config, files []string) (*Reader, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files are given")
+	}
+
+	var linkType layers.LinkType
+	var snapLen uint
+
+	for i, file := range files {
+		handle, err := pcap.OpenOffline(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			linkType = handle.LinkType()
+		} else if handle.LinkType() != linkType {
+			handle.Close()
+			return nil, fmt.Errorf("different linktypes cannot be read: %v (%v), %v (%v)", files[0], linkType, file, handle.LinkType())
+		}
+		if uint(handle.SnapLen()) > snapLen {
+			snapLen = uint(handle.SnapLen())
+		}
+
+		handle.Close()
+	}
+
+	device := DeviceConfig{Name: OfflineDevice, BpfRules: config.Rcap.BpfRules, SnapLen: snapLen}
+
+	slog.Info("read file", "file", files[0])
+	reader, err := openAndSetUpReader(config, device, files[0])
+	if err != nil {
+		return nil, err
+	}
+	reader.files = files[1:]
+
+	return reader, nil
+}
+
+// openNextFile closes the current file and opens the next file.
+func (r *Reader) openNextFile() error {
+	file := r.files[0]
+	r.files = r.files[1:]
+
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return err
+	}
+	if rules := r.Device().BpfRules; rules != "" {
+		if err := handle.SetBPFFilter(rules); err != nil {
+			handle.Close()
+			return err
+		}
+	}
+
+	slog.Info("read file", "file", file)
+	r.handle.Close()
+	r.handle = handle
+
+	return nil
+}
+
 // NewReader creates a new struct Reader. This function calls pcap.OpenLive and
 // applies SetBPFFilter method to the returned handle based on the given Config
-// struct.
-func NewReader(config *Config) (*Reader, error) {
-	return openAndSetUpReader(config, "")
+// struct and DeviceConfig struct (one of Config.Rcap.CaptureDevices()).
+func NewReader(config *Config, device DeviceConfig) (*Reader, error) {
+	return openAndSetUpReader(config, device, "")
 }
 
-// LinkType returns the layers.LinkType of the interface.
+// Device returns the DeviceConfig of the Reader.
+func (r *Reader) Device() DeviceConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.device
+}
+
+// SetBpfRules compiles the BPF rules and sets them to the device. The compiled
+// rules are installed to the handle by the goroutine which reads packets before
+// the next read, because the handle must not be used concurrently. If the rules
+// are invalid, the current rules are kept and an error is returned.
+func (r *Reader) SetBpfRules(rules string) error {
+	device := r.Device()
+	instructions, err := pcap.CompileBPFFilter(r.linkType, int(device.SnapLen), rules)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.device.BpfRules = rules
+	r.pendingBpf = instructions
+	r.mu.Unlock()
+
+	return nil
+}
+
+// applyPendingBpfRules installs the BPF rules set by SetBpfRules to the handle.
+func (r *Reader) applyPendingBpfRules() {
+	r.mu.Lock()
+	instructions := r.pendingBpf
+	r.pendingBpf = nil
+	device := r.device
+	r.mu.Unlock()
+
+	if instructions == nil {
+		return
+	}
+
+	if err := r.handle.SetBPFInstructionFilter(instructions); err != nil {
+		slog.Error("failed to apply BPF rules", "device", device.Name, "bpfRules", device.BpfRules, "error", err)
+		return
+	}
+
+	slog.Info("apply BPF rules", "device", device.Name, "bpfRules", device.BpfRules)
+}
+
+// LinkType returns the layers.LinkType of the interface. It does not use the
+// handle, which is replaced by the goroutine reading the next file.
 func (r *Reader) LinkType() layers.LinkType {
-	return r.handle.LinkType()
+	return r.linkType
 }
 
 // NumPackets returns the number of packets read from the packet source.
 func (r *Reader) NumPackets() uint {
-	return r.numPackets
+	return uint(atomic.LoadUint64(&r.numPackets))
+}
+
+// NumQueueDropped returns the number of packets read from the packet source
+// but dropped because the queue to the writers is full.
+func (r *Reader) NumQueueDropped() uint64 {
+	return atomic.LoadUint64(&r.numQueueDropped)
+}
+
+func (r *Reader) addQueueDropped() {
+	atomic.AddUint64(&r.numQueueDropped, 1)
 }
 
 // ResetNumPackets resets NumPackets to 0.
 func (r *Reader) ResetNumPackets() {
-	r.numPackets = 0
+	atomic.StoreUint64(&r.numPackets, 0)
+}
+
+// Stats returns the latest statistics of libpcap (e.g. packets dropped by the
+// kernel) since the device was opened, which are got by the goroutine reading
+// packets after RequestStats is called. It returns an error if the statistics
+// are not got yet.
+func (r *Reader) Stats() (*pcap.Stats, error) {
+	if r.offline {
+		return nil, errors.New("statistics are not available for pcap files")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.snapshot == nil {
+		return nil, errors.New("statistics are not got yet")
+	}
+	stats := r.snapshot.stats
+	return &stats, nil
+}
+
+// RequestStats requests the goroutine reading packets to get the statistics
+// of libpcap before the next read, because the handle must not be used
+// concurrently.
+func (r *Reader) RequestStats() {
+	atomic.StoreInt32(&r.statsRequested, 1)
+}
+
+// updateRequestedStats gets the statistics of libpcap if they are requested
+// by RequestStats, and takes the snapshot of the counters with them. The
+// counters are updated only by the goroutine reading packets, so they are
+// consistent with the statistics.
+func (r *Reader) updateRequestedStats() {
+	if atomic.SwapInt32(&r.statsRequested, 0) == 0 || r.offline {
+		return
+	}
+
+	stats, err := r.handle.Stats()
+	if err != nil {
+		// The previous statistics are kept.
+		return
+	}
+
+	snapshot := &statsSnapshot{
+		numPackets:   atomic.LoadUint64(&r.numPackets),
+		queueDropped: r.NumQueueDropped(),
+		stats:        *stats,
+	}
+
+	r.mu.Lock()
+	r.snapshot = snapshot
+	r.mu.Unlock()
+}
+
+// statsReport is the statistics of a Reader between two reports.
+type statsReport struct {
+	numPackets   uint64 // Packets read by the Reader.
+	queueDropped uint64 // Packets dropped because the queue is full.
+	received     int    // Packets received by libpcap.
+	dropped      int    // Packets dropped by the kernel (e.g. the buffer is full).
+	ifDropped    int    // Packets dropped by the interface.
+}
+
+// dropRatio returns the ratio of packets dropped by the kernel and the
+// interface to all packets.
+func (s *statsReport) dropRatio() float64 {
+	drops := s.dropped + s.ifDropped
+	if s.received+drops <= 0 {
+		return 0.0
+	}
+	return float64(drops) / float64(s.received+drops)
+}
+
+// statsSnapshot is the counters of a Reader at a time. Each Writer keeps the
+// snapshot at its last report as the baseline of the next one, so the
+// counters of the Reader shared by the Writers are never reset.
+type statsSnapshot struct {
+	numPackets   uint64
+	queueDropped uint64
+	stats        pcap.Stats
+}
+
+// statsSnapshot returns the snapshot taken with the latest statistics of
+// libpcap (see updateRequestedStats). The current counters are returned for
+// pcap files, which have no statistics.
+func (r *Reader) statsSnapshot() statsSnapshot {
+	if r.offline {
+		return statsSnapshot{
+			numPackets:   atomic.LoadUint64(&r.numPackets),
+			queueDropped: r.NumQueueDropped(),
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.snapshot == nil {
+		return statsSnapshot{}
+	}
+	return *r.snapshot
+}
+
+// since returns the statistics from the baseline to the snapshot. Counters
+// reset after the baseline (e.g. by ResetNumPackets) are counted from 0.
+func (s statsSnapshot) since(base statsSnapshot) statsReport {
+	if s.numPackets < base.numPackets {
+		base.numPackets = 0
+	}
+
+	return statsReport{
+		numPackets:   s.numPackets - base.numPackets,
+		queueDropped: s.queueDropped - base.queueDropped,
+		received:     s.stats.PacketsReceived - base.stats.PacketsReceived,
+		dropped:      s.stats.PacketsDropped - base.stats.PacketsDropped,
+		ifDropped:    s.stats.PacketsIfDropped - base.stats.PacketsIfDropped,
+	}
+}
+
+// takeStatsReport returns the statistics of the reader since the last report
+// of the Writer and starts a new report.
+func (w *Writer) takeStatsReport(reader *Reader) statsReport {
+	current := reader.statsSnapshot()
+	report := current.since(w.statsBase[reader])
+
+	if w.statsBase == nil {
+		w.statsBase = make(map[*Reader]statsSnapshot)
+	}
+	w.statsBase[reader] = current
+
+	return report
 }
 
 // ReadPacket returns a packet data with the same format as
-// ZeroCopyReadPacketData.
+// ZeroCopyReadPacketData. When reading pcap files, the next file is opened at
+// the end of each file, and io.EOF is returned at the end of the last file.
 func (r *Reader) ReadPacket() ([]byte, gopacket.CaptureInfo, error) {
+	r.applyPendingBpfRules()
+	r.updateRequestedStats()
+
 	data, capinfo, pkterr := r.handle.ZeroCopyReadPacketData()
 
+	for pkterr == io.EOF && len(r.files) > 0 {
+		if err := r.openNextFile(); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		data, capinfo, pkterr = r.handle.ZeroCopyReadPacketData()
+	}
+
 	if pkterr == nil {
-		r.numPackets++
+		atomic.AddUint64(&r.numPackets, 1)
+
+		// Timestamps are captured in nanosecond precision if possible.
+		if r.config != nil && r.config.Rcap.TimestampPrecision == TimestampPrecisionMicro {
+			capinfo.Timestamp = capinfo.Timestamp.Truncate(time.Microsecond)
+		}
 	}
 
 	return data, capinfo, pkterr
 }
 
+// isTimeout returns true if the error returned from ReadPacket means that no
+// packets are captured before the timeout.
+func isTimeout(err error) bool {
+	return err == pcap.NextErrorTimeoutExpired
+}
+
 // Close closes the handle.
 func (r *Reader) Close() error {
 	// r.handle.Close does not return any error,
@@ -1,11 +1,17 @@
 package rcap
 
 import (
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 )
 
 func makeReader(t *testing.T) *Reader {
@@ -17,6 +23,7 @@ func makeReader(t *testing.T) *Reader {
 	if err != nil {
 		t.Fatalf("failed to make Reader for test: %v", err)
 	}
+	reader.linkType = reader.handle.LinkType()
 
 	return reader
 }
@@ -26,25 +33,26 @@ func TestNewReader(t *testing.T) {
 
 	// OpenLive function in NewReader requires root privilege,
 	// so the following call fails.
-	if _, err := NewReader(c); err == nil {
+	device := c.Rcap.CaptureDevices()[0]
+	if _, err := NewReader(c, device); err == nil {
 		t.Errorf("err is expected, but got '%v'.", err)
 	}
 
 	// Instead, openAndSetUpReader internal function is ready
 	// to test with a pcap file.
-	c.Rcap.BpfRules = "ip"
-	if _, err := openAndSetUpReader(c, "testdata/sample.pcap"); err != nil {
+	device.BpfRules = "ip"
+	if _, err := openAndSetUpReader(c, device, "testdata/sample.pcap"); err != nil {
 		t.Errorf("'%v' is expected, but got '%v'.", nil, err)
 	}
 
 	// file not found
-	if _, err := openAndSetUpReader(c, "testdata/not-found.pcap"); err == nil {
+	if _, err := openAndSetUpReader(c, device, "testdata/not-found.pcap"); err == nil {
 		t.Errorf("err is expected, but got '%v'.", err)
 	}
 
 	// invalid BPF
-	c.Rcap.BpfRules = "invalid bpf"
-	if _, err := openAndSetUpReader(c, "testdata/sample.pcap"); err == nil {
+	device.BpfRules = "invalid bpf"
+	if _, err := openAndSetUpReader(c, device, "testdata/sample.pcap"); err == nil {
 		t.Errorf("err is expected, but got '%v'.", err)
 	}
 }
@@ -105,3 +113,211 @@ func TestReaderClose(t *testing.T) {
 	r := makeReader(t)
 	r.Close()
 }
+
+func TestReaderSetBpfRules(t *testing.T) {
+	reader := makeReader(t)
+	defer reader.Close()
+
+	// The device has the rules at once, and the handle has them on the next
+	// read.
+	if err := reader.SetBpfRules("tcp"); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if got := reader.Device().BpfRules; got != "tcp" || reader.pendingBpf == nil {
+		t.Errorf("'tcp' is expected, but got '%v'.", got)
+	}
+	reader.ReadPacket()
+	if reader.pendingBpf != nil {
+		t.Errorf("nil is expected, but got '%v'.", reader.pendingBpf)
+	}
+
+	// Invalid rules are not applied.
+	if err := reader.SetBpfRules("(invalid"); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+	if got := reader.Device().BpfRules; got != "tcp" || reader.pendingBpf != nil {
+		t.Errorf("'tcp' is expected, but got '%v'.", got)
+	}
+}
+
+func TestReaderRequestStats(t *testing.T) {
+	reader := makeReader(t)
+	defer reader.Close()
+
+	// No statistics are got until they are requested.
+	reader.ReadPacket()
+	if _, err := reader.Stats(); err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+
+	// The statistics are got by the next read.
+	reader.RequestStats()
+	if reader.statsRequested != 1 {
+		t.Errorf("'1' is expected, but got '%v'.", reader.statsRequested)
+	}
+	reader.ReadPacket()
+	if reader.statsRequested != 0 {
+		t.Errorf("'0' is expected, but got '%v'.", reader.statsRequested)
+	}
+}
+
+func TestReaderStatsSnapshot(t *testing.T) {
+	// The current counters of pcap files.
+	r := &Reader{numPackets: 100, numQueueDropped: 5, offline: true}
+	if got := r.statsSnapshot(); got.numPackets != 100 || got.queueDropped != 5 {
+		t.Errorf("the current counters are expected, but got '%+v'.", got)
+	}
+
+	// The snapshot taken with the statistics of libpcap.
+	r = &Reader{numPackets: 100, numQueueDropped: 5}
+	if got := r.statsSnapshot(); got != (statsSnapshot{}) {
+		t.Errorf("the empty snapshot is expected, but got '%+v'.", got)
+	}
+	expected := statsSnapshot{numPackets: 90, queueDropped: 3, stats: pcap.Stats{PacketsReceived: 90}}
+	r.snapshot = &expected
+	if got := r.statsSnapshot(); got != expected {
+		t.Errorf("'%+v' is expected, but got '%+v'.", expected, got)
+	}
+	if stats, err := r.Stats(); err != nil || stats.PacketsReceived != 90 {
+		t.Errorf("'90' is expected, but got '%+v' (err: %v).", stats, err)
+	}
+}
+
+func TestStatsSnapshotSince(t *testing.T) {
+	base := statsSnapshot{numPackets: 100, queueDropped: 5, stats: pcap.Stats{PacketsReceived: 90, PacketsDropped: 10}}
+	report := base.since(statsSnapshot{})
+	expected := statsReport{numPackets: 100, queueDropped: 5, received: 90, dropped: 10}
+	if report != expected {
+		t.Errorf("'%+v' is expected, but got '%+v'.", expected, report)
+	}
+	if ratio := report.dropRatio(); ratio != 0.1 {
+		t.Errorf("'0.1' is expected, but got '%v'.", ratio)
+	}
+
+	// The next report has the difference from the last one.
+	current := statsSnapshot{numPackets: 150, queueDropped: 8, stats: pcap.Stats{PacketsReceived: 140, PacketsDropped: 10, PacketsIfDropped: 10}}
+	report = current.since(base)
+	expected = statsReport{numPackets: 50, queueDropped: 3, received: 50, dropped: 0, ifDropped: 10}
+	if report != expected {
+		t.Errorf("'%+v' is expected, but got '%+v'.", expected, report)
+	}
+
+	// No packets.
+	report = current.since(current)
+	if ratio := report.dropRatio(); ratio != 0.0 {
+		t.Errorf("'0' is expected, but got '%v'.", ratio)
+	}
+
+	// NumPackets is reset after the baseline.
+	if report := (statsSnapshot{numPackets: 10}).since(current); report.numPackets != 10 {
+		t.Errorf("'10' is expected, but got '%v'.", report.numPackets)
+	}
+}
+
+func TestReaderReadPacketTimestampPrecision(t *testing.T) {
+	c := makeConfig()
+
+	for _, precision := range []string{TimestampPrecisionMicro, TimestampPrecisionNano} {
+		c.Rcap.TimestampPrecision = precision
+		r, _ := openAndSetUpReader(c, c.Rcap.CaptureDevices()[0], "testdata/sample.pcap")
+
+		_, capinfo, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if capinfo.Timestamp.Nanosecond()%1000 != 0 {
+			t.Errorf("timestamp in microseconds is expected, but got '%v'.", capinfo.Timestamp)
+		}
+
+		r.Close()
+	}
+}
+
+// make a pcap file which has a packet every second from ts.
+func makePcapFile(t *testing.T, filename string, linkType layers.LinkType, ts int64, numPackets int) {
+	os.MkdirAll(filepath.Dir(filename), 0755)
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("failed to make file: %v", err)
+	}
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	w.WriteFileHeader(65535, linkType)
+
+	data := []byte("data")
+	for i := 0; i < numPackets; i++ {
+		capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(ts+int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		w.WritePacket(capinfo, data)
+	}
+}
+
+func TestNewFileReader(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+
+	files := []string{filepath.Join(tempDir, "a.pcap"), filepath.Join(tempDir, "b.pcap")}
+	makePcapFile(t, files[0], layers.LinkTypeEthernet, 86400, 3)
+	makePcapFile(t, files[1], layers.LinkTypeEthernet, 86403, 2)
+
+	r, err := NewFileReader(c, files)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.Device().Name != OfflineDevice || r.Device().SnapLen != 65535 {
+		t.Errorf("'%v' is expected, but got '%v'.", OfflineDevice, r.Device())
+	}
+
+	// Packets are read from the files in order.
+	for ts := int64(86400); ts < 86405; ts++ {
+		_, capinfo, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if capinfo.Timestamp.Unix() != ts {
+			t.Errorf("'%v' is expected, but got '%v'.", ts, capinfo.Timestamp.Unix())
+		}
+	}
+	if _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("io.EOF is expected, but got '%v'.", err)
+	}
+	r.RequestStats()
+	r.ReadPacket()
+	if _, err := r.Stats(); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+	r.Close()
+
+	// The linktype is read while the next file is opened (run with -race).
+	r, _ = NewFileReader(c, files)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := r.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if linkType := r.LinkType(); linkType != layers.LinkTypeEthernet {
+			t.Errorf("'%v' is expected, but got '%v'.", layers.LinkTypeEthernet, linkType)
+		}
+	}
+	<-done
+	r.Close()
+
+	// Different linktypes.
+	makePcapFile(t, files[1], layers.LinkTypeLinuxSLL, 86403, 2)
+	if _, err := NewFileReader(c, files); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+
+	// No files.
+	if _, err := NewFileReader(c, nil); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+	if _, err := NewFileReader(c, []string{filepath.Join(tempDir, "not-found.pcap")}); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
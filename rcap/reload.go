@@ -0,0 +1,95 @@
+package rcap
+
+import (
+	"reflect"
+)
+
+// configChanges is the changes between two configs, which decide what has to
+// be reopened to apply the new config. Other params (e.g. sampling, rate
+// limits and logging) are applied in place.
+type configChanges struct {
+	readers     bool // Reopen the readers (and the writers).
+	bpfRules    bool // Apply the new BPF rules to the readers.
+	writers     bool // Reopen the writers.
+	rateLimiter bool // Remake the rate limiter (its buckets are refilled).
+	sampler     bool // Remake the sampler (its counter and random generator are reset).
+}
+
+// readerParams returns the params which are applied when the readers are
+// opened (including the queue of captured packets). BPF rules are excluded
+// because they are applied to open readers.
+func readerParams(c *RcapConfig) []interface{} {
+	var devices []DeviceConfig
+	for _, device := range c.CaptureDevices() {
+		device.BpfRules = ""
+		devices = append(devices, device)
+	}
+
+	return []interface{}{
+		devices, c.Promisc, c.ToMs, c.BufferSize, c.ImmediateMode,
+		c.TimestampPrecision, c.TimestampType, c.ReadFiles, c.QueueSize, c.QueuePolicy,
+	}
+}
+
+// bpfRules returns the BPF rules of the readers in the order of the readers.
+func bpfRules(c *RcapConfig) []string {
+	if c.OfflineMode() {
+		return []string{c.BpfRules}
+	}
+
+	var rules []string
+	for _, device := range c.CaptureDevices() {
+		rules = append(rules, device.BpfRules)
+	}
+	return rules
+}
+
+// samplingParams returns the params of the sampler.
+func samplingParams(c *RcapConfig) []interface{} {
+	return []interface{}{c.Sampling, c.SamplingStrategy, c.SamplingSeed}
+}
+
+// rateLimitParams returns the params of the rate limiter.
+func rateLimitParams(c *RcapConfig) []interface{} {
+	return []interface{}{c.RateLimitPackets, c.RateLimitBytes, c.RateLimitPerSource}
+}
+
+// writerParams returns the params which are applied when the writers are
+// opened.
+func writerParams(c *RcapConfig) []interface{} {
+	params := []interface{}{
+		c.FileFmt, c.FileAppend, c.OutputFormat, c.Timezone, c.Interval,
+		c.Offset, c.UTCOffset, c.AppendMismatch, c.Compression, c.CompressionMode,
+		c.MaxFileBytes, c.MaxFilePackets, c.RingFiles, c.Sinks,
+		c.PartFiles, c.PartSuffix, c.WriteBufferSize, c.FlushInterval, c.FsyncPolicy, c.FsyncInterval,
+		c.RetentionMaxAge, c.RetentionMaxBytes, c.RetentionMaxFiles, c.RetentionMinFreeBytes,
+		c.HookCommand, c.HookTimeout, c.HookConcurrency,
+		c.Trigger, c.TriggerFilter, c.TriggerPre, c.TriggerPreBytes, c.TriggerPost,
+		c.Manifest, c.ManifestIndex,
+	}
+
+	// Samplers of the sinks are made with the global strategy and seed.
+	if len(c.Sinks) > 0 {
+		params = append(params, c.SamplingStrategy, c.SamplingSeed)
+	}
+
+	return params
+}
+
+// diffConfig returns the changes from the old config to the new one.
+func diffConfig(old *RcapConfig, new *RcapConfig) configChanges {
+	var changes configChanges
+
+	changes.readers = !reflect.DeepEqual(readerParams(old), readerParams(new))
+	changes.bpfRules = !reflect.DeepEqual(bpfRules(old), bpfRules(new))
+	changes.writers = !reflect.DeepEqual(writerParams(old), writerParams(new))
+	changes.sampler = !reflect.DeepEqual(samplingParams(old), samplingParams(new))
+	changes.rateLimiter = !reflect.DeepEqual(rateLimitParams(old), rateLimitParams(new))
+
+	// BPF rules and the sampling rate are written to manifests by the writers.
+	if (changes.bpfRules || old.Sampling != new.Sampling) && (new.Manifest || new.ManifestIndex != "") {
+		changes.writers = true
+	}
+
+	return changes
+}
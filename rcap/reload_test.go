@@ -0,0 +1,240 @@
+package rcap
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		modify   func(r *RcapConfig)
+		expected configChanges
+	}{
+		{"no changes", func(r *RcapConfig) {}, configChanges{}},
+		{"sampling", func(r *RcapConfig) { r.Sampling = 0.5; r.LogLevel = "debug" }, configChanges{sampler: true}},
+		{"bpfRules", func(r *RcapConfig) { r.BpfRules = "tcp" }, configChanges{bpfRules: true}},
+		{"bpfRules of devices", func(r *RcapConfig) { r.Devices = []DeviceConfig{{Name: "any", BpfRules: "tcp"}} }, configChanges{bpfRules: true}},
+		{"fileFmt", func(r *RcapConfig) { r.FileFmt = "dump/%Y/traffic.pcap" }, configChanges{writers: true}},
+		{"interval", func(r *RcapConfig) { r.Interval = 3600 }, configChanges{writers: true}},
+		{"timezone", func(r *RcapConfig) { r.Timezone = "Asia/Tokyo" }, configChanges{writers: true}},
+		{"device", func(r *RcapConfig) { r.Device = "lo" }, configChanges{readers: true}},
+		{"snaplen", func(r *RcapConfig) { r.SnapLen = 128 }, configChanges{readers: true}},
+		{"promisc", func(r *RcapConfig) { r.Promisc = false }, configChanges{readers: true}},
+		{"manifest", func(r *RcapConfig) { r.Manifest = true }, configChanges{writers: true}},
+		{"sampling with manifest", func(r *RcapConfig) { r.Sampling = 0.5; r.Manifest = true }, configChanges{writers: true, sampler: true}},
+		{"samplingSeed", func(r *RcapConfig) { r.SamplingSeed = 1 }, configChanges{sampler: true}},
+		{"bpfRules with manifest", func(r *RcapConfig) { r.BpfRules = "tcp"; r.ManifestIndex = "index.jsonl" }, configChanges{bpfRules: true, writers: true}},
+		{"rateLimitPackets", func(r *RcapConfig) { r.RateLimitPackets = 100 }, configChanges{rateLimiter: true}},
+		{"rateLimitPerSource", func(r *RcapConfig) { r.RateLimitPerSource = true }, configChanges{rateLimiter: true}},
+	}
+
+	for _, tc := range cases {
+		old, new := makeConfig(), makeConfig()
+		tc.modify(&new.Rcap)
+		if got := diffConfig(&old.Rcap, &new.Rcap); got != tc.expected {
+			t.Errorf("%v: '%+v' is expected, but got '%+v'.", tc.name, tc.expected, got)
+		}
+	}
+
+	// The strategy of sampling is used by the samplers of the sinks.
+	old, new := makeConfig(), makeConfig()
+	old.Rcap.Sinks = []SinkConfig{{Name: "test"}}
+	new.Rcap.Sinks = []SinkConfig{{Name: "test"}}
+	new.Rcap.SamplingStrategy = SamplingNth
+	if got := diffConfig(&old.Rcap, &new.Rcap); !got.writers {
+		t.Errorf("writers are expected to be reopened, but got '%+v'.", got)
+	}
+}
+
+func TestRunnerReloadInPlace(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := filepath.Join(tempDir, "rcap.toml")
+	fileFmt := filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+
+	writeConfig := func(body string) {
+		data := "[rcap]\ndevice = \"any\"\nfileFmt = \"" + fileFmt + "\"\n" + body
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	writeConfig("")
+	c, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+	reader, sinks := r.readers[0], r.sinks
+
+	// Sampling is applied in place.
+	writeConfig("sampling = 0.5\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.readers[0] != reader || r.sinks[0] != sinks[0] || !r.config.Rcap.SamplingMode {
+		t.Errorf("the same reader and writers with sampling are expected.")
+	}
+
+	// The sampler and the rate limiter are kept unless they are changed.
+	writeConfig("sampling = 0.5\nrateLimitPackets = 100.0\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	limiter, sampler := r.limiter, r.sampler
+	writeConfig("sampling = 0.5\nrateLimitPackets = 100.0\nlogLevel = \"debug\"\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if limiter == nil || r.limiter != limiter {
+		t.Errorf("the same rate limiter is expected.")
+	}
+	if r.sampler != sampler {
+		t.Errorf("the same sampler is expected.")
+	}
+	writeConfig("sampling = 0.5\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.limiter != nil {
+		t.Errorf("no rate limiter is expected.")
+	}
+
+	// BPF rules are applied to the reader.
+	writeConfig("bpfRules = \"tcp\"\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.readers[0] != reader || r.sinks[0] != sinks[0] || r.readers[0].Device().BpfRules != "tcp" {
+		t.Errorf("the same reader with the new BPF rules is expected.")
+	}
+
+	// The writers opened after that have the new BPF rules (before the
+	// reader reads the next packet).
+	r.closeWriters()
+	r.setupWriters()
+	if got := r.sinks[0].writers[0].interfaces[0].device.BpfRules; got != "tcp" {
+		t.Errorf("'tcp' is expected, but got '%v'.", got)
+	}
+
+	// The writers are reopened.
+	writeConfig("bpfRules = \"tcp\"\ninterval = 3600\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.readers[0] != reader || r.sinks != nil {
+		t.Errorf("the same reader and no writers are expected.")
+	}
+
+	// The readers are reopened.
+	r.setupWriters()
+	writeConfig("bpfRules = \"tcp\"\ninterval = 3600\npromisc = false\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.readers != nil || r.sinks != nil {
+		t.Errorf("no readers and writers are expected.")
+	}
+}
+
+func TestRunnerReloadManifestSampling(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := filepath.Join(tempDir, "rcap.toml")
+	fileFmt := filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+
+	writeConfig := func(body string) {
+		data := "[rcap]\ndevice = \"any\"\nmanifest = true\nfileFmt = \"" + fileFmt + "\"\n" + body
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	writeConfig("")
+	c, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+
+	// The writers are reopened to write the new rate to manifests.
+	writeConfig("sampling = 0.5\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.sinks != nil {
+		t.Fatalf("no writers are expected.")
+	}
+	r.setupWriters()
+
+	writer := r.sinks[0].writers[0]
+	writer.Update(86400)
+	r.Close()
+	backgroundJobs.Wait()
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "traffic-19700102-000000.pcap"+ManifestSuffix))
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	var got manifest
+	json.Unmarshal(data, &got)
+	if got.Sampling != 0.5 {
+		t.Errorf("'0.5' is expected, but got '%v'.", got.Sampling)
+	}
+}
+
+func TestRunnerReloadManifestBpfRules(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := filepath.Join(tempDir, "rcap.toml")
+	fileFmt := filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+
+	writeConfig := func(body string) {
+		data := "[rcap]\ndevice = \"any\"\nmanifest = true\nfileFmt = \"" + fileFmt + "\"\n" + body
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	writeConfig("")
+	c, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+
+	// The writers are reopened to write the new rules to manifests. No packets
+	// are read after reloading.
+	writeConfig("bpfRules = \"tcp\"\n")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if r.sinks != nil {
+		t.Fatalf("no writers are expected.")
+	}
+	r.setupWriters()
+
+	writer := r.sinks[0].writers[0]
+	writer.Update(86400)
+	r.Close()
+	backgroundJobs.Wait()
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "traffic-19700102-000000.pcap"+ManifestSuffix))
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	var got manifest
+	json.Unmarshal(data, &got)
+	if len(got.Devices) != 1 || got.Devices[0].BpfRules != "tcp" {
+		t.Errorf("'tcp' is expected, but got '%+v'.", got.Devices)
+	}
+}
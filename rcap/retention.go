@@ -0,0 +1,275 @@
+package rcap
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// captureFile is a file written by Writer.
+type captureFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// busyFiles counts the background jobs (e.g. compression, manifests and hooks)
+// using each file. Busy files are never removed by the retention policy.
+var busyFiles = struct {
+	sync.Mutex
+	paths map[string]int
+}{paths: make(map[string]int)}
+
+// holdFile marks the file as busy until releaseFile is called.
+func holdFile(path string) {
+	busyFiles.Lock()
+	busyFiles.paths[filepath.Clean(path)]++
+	busyFiles.Unlock()
+}
+
+// releaseFile releases the file held by holdFile.
+func releaseFile(path string) {
+	path = filepath.Clean(path)
+
+	busyFiles.Lock()
+	if busyFiles.paths[path]--; busyFiles.paths[path] <= 0 {
+		delete(busyFiles.paths, path)
+	}
+	busyFiles.Unlock()
+}
+
+// isBusyFile returns true if the file is held by background jobs.
+func isBusyFile(path string) bool {
+	busyFiles.Lock()
+	defer busyFiles.Unlock()
+	return busyFiles.paths[filepath.Clean(path)] > 0
+}
+
+// fileFmtPattern returns a regexp which matches filenames made from the
+// format by makeFileName, including suffixes (e.g. -1) and extensions of
+// compression (e.g. .gz).
+func fileFmtPattern(format string) *regexp.Regexp {
+	var b strings.Builder
+
+	ext := filepath.Ext(format)
+	if strings.Contains(ext, "%") {
+		ext = ""
+	}
+	base := format[:len(format)-len(ext)]
+
+	for i := 0; i < len(base); i++ {
+		if base[i] == '%' && i+1 < len(base) {
+			i++
+			if base[i] == '%' {
+				b.WriteString("%")
+			} else {
+				// Any directive of strftime (and DeviceToken) is replaced
+				// with a path component.
+				b.WriteString(`[^/]+`)
+			}
+			continue
+		}
+		b.WriteString(regexp.QuoteMeta(base[i : i+1]))
+	}
+
+	b.WriteString(`(-[0-9]+)?`)
+	b.WriteString(regexp.QuoteMeta(ext))
+	b.WriteString(`(\.gz|\.zst|\.lz4)?`)
+
+	return regexp.MustCompile("^" + b.String() + "$")
+}
+
+// fileFmtRoot returns the deepest directory of the format which contains no
+// directives.
+func fileFmtRoot(format string) string {
+	dir := filepath.Dir(format)
+	for strings.Contains(dir, "%") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// findCaptureFiles returns files made from the format, sorted from the oldest.
+func findCaptureFiles(format string) ([]captureFile, error) {
+	pattern := fileFmtPattern(filepath.Clean(format))
+	root := fileFmtRoot(filepath.Clean(format))
+
+	var files []captureFile
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable files and directories.
+			return nil
+		}
+		if d.IsDir() || !pattern.MatchString(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		files = append(files, captureFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	return files, err
+}
+
+// freeSpace returns available bytes of the filesystem which has the path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// retentionEnabled returns true if any retention policy is set.
+func (r *RcapConfig) retentionEnabled() bool {
+	return r.RetentionMaxAge > 0 || r.RetentionMaxBytes > 0 || r.RetentionMaxFiles > 0 || r.RetentionMinFreeBytes > 0
+}
+
+// removeCaptureFile removes the file and its directory if it becomes empty.
+func removeCaptureFile(file captureFile, root string, reason string) bool {
+	if err := os.Remove(file.path); err != nil {
+		slog.Error("failed to remove file", "file", file.path, "error", err)
+		return false
+	}
+
+	slog.Info("remove file", "file", file.path, "bytes", file.size, "reason", reason)
+
+	// The manifest (if any) is removed with the file.
+	if err := os.Remove(file.path + ManifestSuffix); err != nil && !os.IsNotExist(err) {
+		slog.Error("failed to remove file", "file", file.path+ManifestSuffix, "error", err)
+	}
+
+	// Remove empty directories (e.g. dump/%Y%m%d) up to the root.
+	for dir := filepath.Dir(file.path); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			break
+		}
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return true
+}
+
+// applyRetention removes files made from the format according to the
+// retention policy of the config, and returns the removed files. The files in
+// exclude (e.g. the file currently open) and the files held by background jobs
+// are never removed.
+func applyRetention(c *RcapConfig, format string, exclude []string, now time.Time) []captureFile {
+	files, err := findCaptureFiles(format)
+	if err != nil {
+		slog.Error("failed to find files for retention", "error", err)
+	}
+
+	root := fileFmtRoot(filepath.Clean(format))
+	excluded := make(map[string]bool)
+	for _, path := range exclude {
+		excluded[filepath.Clean(path)] = true
+	}
+
+	var kept, removed []captureFile
+	var numFiles uint
+	var totalBytes int64
+
+	// Remove old files.
+	for _, file := range files {
+		if excluded[file.path] || isBusyFile(file.path) {
+			// Excluded files are counted, but never removed.
+			numFiles++
+			totalBytes += file.size
+			continue
+		}
+		if c.RetentionMaxAge > 0 && now.Sub(file.modTime) > c.RetentionMaxAge {
+			if removeCaptureFile(file, root, "maxAge") {
+				removed = append(removed, file)
+				continue
+			}
+		}
+		kept = append(kept, file)
+		numFiles++
+		totalBytes += file.size
+	}
+
+	// Remove the oldest files until the other policies are satisfied.
+	for len(kept) > 0 {
+		var reason string
+
+		switch {
+		case c.RetentionMaxFiles > 0 && numFiles > c.RetentionMaxFiles:
+			reason = "maxFiles"
+		case c.RetentionMaxBytes > 0 && totalBytes > c.RetentionMaxBytes:
+			reason = "maxBytes"
+		case c.RetentionMinFreeBytes > 0:
+			free, err := freeSpace(root)
+			if err == nil && free < c.RetentionMinFreeBytes {
+				reason = "minFreeBytes"
+			}
+		}
+
+		if reason == "" {
+			break
+		}
+
+		file := kept[0]
+		kept = kept[1:]
+		if removeCaptureFile(file, root, reason) {
+			removed = append(removed, file)
+			numFiles--
+			totalBytes -= file.size
+		}
+	}
+
+	return removed
+}
+
+// applyRetention applies the retention policy to the files of the Writer in
+// background. The file currently open and the files used by background jobs
+// (e.g. the file just closed and being compressed) are never removed. If the
+// previous pass is still running, this pass is skipped.
+func (w *Writer) applyRetention() {
+	c := &w.config.Rcap
+	if !c.retentionEnabled() {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&w.retentionRunning, 0, 1) {
+		return
+	}
+
+	var exclude []string
+	if w.file != nil {
+		exclude = append(exclude, w.file.Name())
+	}
+
+	backgroundJobs.Add(1)
+
+	go func() {
+		defer backgroundJobs.Done()
+		defer atomic.StoreInt32(&w.retentionRunning, 0)
+
+		removed := applyRetention(c, w.fileFmt, exclude, time.Now())
+		if len(removed) > 0 {
+			slog.Info("retention applied", "removedFiles", len(removed))
+		}
+	}()
+}
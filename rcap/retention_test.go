@@ -0,0 +1,202 @@
+package rcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestFileFmtPattern(t *testing.T) {
+	cases := []struct {
+		// in
+		format   string
+		filename string
+		// out
+		match bool
+	}{
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/traffic-20230701120000.pcap", true},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/traffic-20230701120000-1.pcap", true},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/traffic-20230701120000.pcap.gz", true},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/traffic-20230701120000-2.pcap.zst", true},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/traffic-20230701120000.txt", false},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/20230701/other-20230701120000.pcap", false},
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump/traffic-20230701120000.pcap", false},
+		{"dump/%i/%Y%m%d.pcap", "dump/eth0/20230701.pcap", true},
+		{"traffic.pcap", "traffic.pcap", true},
+		{"traffic.pcap", "traffic-1.pcap.lz4", true},
+		{"100%%-%Y.pcap", "100%-2023.pcap", true},
+	}
+
+	for _, c := range cases {
+		if match := fileFmtPattern(c.format).MatchString(c.filename); match != c.match {
+			t.Errorf("'%v' is expected, but got '%v': format=%v, filename=%v", c.match, match, c.format, c.filename)
+		}
+	}
+}
+
+func TestFileFmtRoot(t *testing.T) {
+	cases := []struct {
+		// in
+		format string
+		// out
+		root string
+	}{
+		{"dump/%Y%m%d/traffic-%Y%m%d%H%M00.pcap", "dump"},
+		{"/var/dump/%i/%Y/%m/%d.pcap", "/var/dump"},
+		{"traffic-%Y.pcap", "."},
+	}
+
+	for _, c := range cases {
+		if root := fileFmtRoot(c.format); root != c.root {
+			t.Errorf("'%v' is expected, but got '%v'.", c.root, root)
+		}
+	}
+}
+
+// make files with the given size and modification time (in order).
+func makeCaptureFiles(t *testing.T, dir string, names []string, size int, now time.Time) {
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatalf("failed to make file: %v", err)
+		}
+		modTime := now.Add(time.Duration(i-len(names)) * time.Hour)
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Now()
+	names := []string{"20230701/a.pcap", "20230702/b.pcap", "20230703/c.pcap", "20230704/d.pcap"}
+
+	cases := []struct {
+		// in
+		config RcapConfig
+		// out
+		numRemoved int
+	}{
+		{RcapConfig{}, 0},
+		{RcapConfig{RetentionMaxAge: 150 * time.Minute}, 2},
+		{RcapConfig{RetentionMaxFiles: 3}, 1},
+		{RcapConfig{RetentionMaxBytes: 250}, 2},
+		{RcapConfig{RetentionMaxFiles: 1}, 3},
+		{RcapConfig{RetentionMinFreeBytes: 1 << 62}, 3}, // The current file is kept.
+	}
+
+	for _, c := range cases {
+		tempDir := t.TempDir()
+		makeCaptureFiles(t, tempDir, names, 100, now)
+		format := filepath.Join(tempDir, "%Y%m%d", "%H.pcap")
+		current := filepath.Join(tempDir, "20230704", "d.pcap")
+
+		removed := applyRetention(&c.config, format, []string{current}, now)
+		if len(removed) != c.numRemoved {
+			t.Errorf("%v file(s) are expected to be removed, but got %v: %+v", c.numRemoved, len(removed), c.config)
+		}
+
+		// The oldest files are removed first, and the current file is kept.
+		for i, file := range removed {
+			if expected := filepath.Join(tempDir, names[i]); file.path != expected {
+				t.Errorf("'%v' is expected, but got '%v'.", expected, file.path)
+			}
+		}
+		if !FileExists(current) {
+			t.Errorf("'%v' is removed.", current)
+		}
+
+		// Empty directories are removed too.
+		if len(removed) > 0 && FileExists(filepath.Dir(removed[0].path)) {
+			t.Errorf("'%v' is not removed.", filepath.Dir(removed[0].path))
+		}
+	}
+}
+
+func TestWriterApplyRetention(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.RetentionMaxFiles = 2
+	c.CheckAndFormat()
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	for ts := int64(86400); ts < 86400+300; ts++ {
+		w.Update(ts)
+		backgroundJobs.Wait()
+	}
+	w.Close()
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	if numFiles := len(files); numFiles != 2 {
+		t.Errorf("2 files are expected, but got %v file(s).", numFiles)
+	}
+}
+
+func TestRemoveCaptureFileWithManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "20230701", "a.pcap")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("data"), 0644)
+	os.WriteFile(path+ManifestSuffix, []byte("{}"), 0644)
+
+	// The manifest is removed with the file (and the directory).
+	if !removeCaptureFile(captureFile{path: path}, tempDir, "test") {
+		t.Error("true is expected, but got false.")
+	}
+	if FileExists(path+ManifestSuffix) || FileExists(filepath.Dir(path)) {
+		t.Errorf("'%v' is expected to be removed.", path+ManifestSuffix)
+	}
+}
+
+func TestApplyRetentionWithBusyFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Now()
+	names := []string{"20230701/a.pcap", "20230702/b.pcap", "20230703/c.pcap"}
+	makeCaptureFiles(t, tempDir, names, 100, now)
+	format := filepath.Join(tempDir, "%Y%m%d", "%H.pcap")
+
+	// The oldest file is held by a background job (e.g. compression).
+	busy := filepath.Join(tempDir, names[0])
+	holdFile(busy)
+
+	c := RcapConfig{RetentionMaxFiles: 2}
+	removed := applyRetention(&c, format, nil, now)
+	if len(removed) != 1 || removed[0].path != filepath.Join(tempDir, names[1]) {
+		t.Errorf("'%v' is expected to be removed, but got '%+v'.", names[1], removed)
+	}
+	if !FileExists(busy) {
+		t.Errorf("'%v' is removed.", busy)
+	}
+
+	// The file is removed after it is released.
+	releaseFile(busy)
+	c.RetentionMaxFiles = 1
+	if isBusyFile(busy) {
+		t.Errorf("'%v' is expected to be released.", busy)
+	}
+	if removed := applyRetention(&c, format, nil, now); len(removed) != 1 || removed[0].path != busy {
+		t.Errorf("'%v' is expected to be removed, but got '%+v'.", busy, removed)
+	}
+}
+
+func TestCompressFileInBackgroundHoldsFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pcap")
+	os.WriteFile(filename, []byte("data"), 0644)
+
+	var busy bool
+	compressFileInBackground(filename, CompressionGzip, func(compressed string) {
+		busy = isBusyFile(filename) && isBusyFile(compressed)
+	})
+	backgroundJobs.Wait()
+
+	if !busy {
+		t.Error("the files are expected to be held until done returns.")
+	}
+	if isBusyFile(filename) || isBusyFile(filename+".gz") {
+		t.Error("the files are expected to be released.")
+	}
+}
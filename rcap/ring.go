@@ -0,0 +1,120 @@
+package rcap
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ringBuffer cycles through a fixed number of files (slots) and overwrites
+// the oldest one. The last slot is saved to a state file next to the files, so
+// a restart continues with the next slot.
+type ringBuffer struct {
+	fileFmt  string // Path of files without strftime directives.
+	numFiles uint
+	slot     uint // Last slot used.
+	loaded   bool // The last slot is loaded from the state file.
+}
+
+func newRingBuffer(fileFmt string, numFiles uint) *ringBuffer {
+	return &ringBuffer{fileFmt: fileFmt, numFiles: numFiles}
+}
+
+// hasTimeDirective returns true if the format contains strftime directives
+// other than DeviceToken.
+func hasTimeDirective(format string) bool {
+	format = strings.ReplaceAll(format, "%%", "")
+	format = strings.ReplaceAll(format, DeviceToken, "")
+	return strings.Contains(format, "%")
+}
+
+// fileName returns the filename of the slot (e.g. traffic-03.pcap). The slot
+// number is padded with zeros to the width of the max slot.
+func (r *ringBuffer) fileName(slot uint) string {
+	width := len(strconv.FormatUint(uint64(r.numFiles-1), 10))
+	ext := filepath.Ext(r.fileFmt)
+	return fmt.Sprintf("%s-%0*d%s", r.fileFmt[:len(r.fileFmt)-len(ext)], width, slot, ext)
+}
+
+// statePath returns the path of the state file (e.g. .traffic.ring).
+func (r *ringBuffer) statePath() string {
+	dir, base := filepath.Split(r.fileFmt)
+	return filepath.Join(dir, "."+strings.TrimSuffix(base, filepath.Ext(base))+".ring")
+}
+
+// loadSlot returns the last slot saved in the state file. It returns false if
+// the state file does not exist or is broken.
+func (r *ringBuffer) loadSlot() (uint, bool) {
+	data, err := os.ReadFile(r.statePath())
+	if err != nil {
+		return 0, false
+	}
+
+	slot, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		slog.Warn("ignore the broken state of the ring buffer", "file", r.statePath(), "error", err)
+		return 0, false
+	}
+	return uint(slot), true
+}
+
+// saveSlot saves the slot to the state file. The file is replaced atomically
+// so that it is never broken by a crash.
+func (r *ringBuffer) saveSlot(slot uint) error {
+	path := r.statePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, strconv.FormatUint(uint64(slot), 10)+"\n")
+		return err
+	})
+}
+
+// next moves to the next slot and returns its filename. The existing file of
+// the slot (and the ones with the given extensions, e.g. ".gz") is removed.
+func (r *ringBuffer) next(extensions ...string) (string, error) {
+	if !r.loaded {
+		if slot, ok := r.loadSlot(); ok {
+			r.slot = slot
+		} else {
+			// Start with slot 0.
+			r.slot = r.numFiles - 1
+		}
+		r.loaded = true
+	}
+
+	slot := (r.slot + 1) % r.numFiles
+	fileName := r.fileName(slot)
+
+	for _, name := range append([]string{fileName}, suffixed(fileName, extensions)...) {
+		if err := os.Remove(name); err == nil {
+			slog.Info("overwrite the oldest file of the ring buffer", "file", name, "slot", slot)
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	if err := r.saveSlot(slot); err != nil {
+		return "", err
+	}
+
+	r.slot = slot
+	return fileName, nil
+}
+
+// suffixed returns the filename with each of the extensions.
+func suffixed(fileName string, extensions []string) []string {
+	var names []string
+	for _, ext := range extensions {
+		if ext != "" {
+			names = append(names, fileName+ext)
+		}
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package rcap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestHasTimeDirective(t *testing.T) {
+	cases := []struct {
+		format   string
+		expected bool
+	}{
+		{"dump/traffic.pcap", false},
+		{"dump/%i/traffic.pcap", false},
+		{"dump/traffic-100%%.pcap", false},
+		{"dump/traffic-%Y%m%d.pcap", true},
+		{"dump/%Y/traffic.pcap", true},
+	}
+
+	for _, tc := range cases {
+		if got := hasTimeDirective(tc.format); got != tc.expected {
+			t.Errorf("%v: '%v' is expected, but got '%v'.", tc.format, tc.expected, got)
+		}
+	}
+}
+
+func TestRingBufferFileName(t *testing.T) {
+	cases := []struct {
+		numFiles uint
+		slot     uint
+		expected string
+	}{
+		{1, 0, "dump/traffic-0.pcap"},
+		{10, 3, "dump/traffic-3.pcap"},
+		{11, 3, "dump/traffic-03.pcap"},
+		{1000, 42, "dump/traffic-042.pcap"},
+	}
+
+	for _, tc := range cases {
+		r := newRingBuffer("dump/traffic.pcap", tc.numFiles)
+		if got := r.fileName(tc.slot); got != tc.expected {
+			t.Errorf("'%v' is expected, but got '%v'.", tc.expected, got)
+		}
+	}
+
+	r := newRingBuffer("dump/traffic.pcap", 3)
+	if expected, got := filepath.Join("dump", ".traffic.ring"), r.statePath(); got != expected {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+	}
+}
+
+func TestRingBufferNext(t *testing.T) {
+	tempDir := t.TempDir()
+	fileFmt := filepath.Join(tempDir, "traffic.pcap")
+
+	r := newRingBuffer(fileFmt, 3)
+	for _, expected := range []uint{0, 1, 2, 0} {
+		name, err := r.next(".gz")
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if got := r.fileName(expected); name != got {
+			t.Errorf("'%v' is expected, but got '%v'.", got, name)
+		}
+		os.WriteFile(name+".gz", []byte("data"), 0644)
+	}
+
+	// A restart continues with the next slot, and the oldest file is removed.
+	r = newRingBuffer(fileFmt, 3)
+	name, err := r.next(".gz")
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if expected := r.fileName(1); name != expected {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, name)
+	}
+	if FileExists(name + ".gz") {
+		t.Errorf("'%v' is expected to be removed.", name+".gz")
+	}
+
+	// A broken state starts with slot 0.
+	os.WriteFile(r.statePath(), []byte("broken"), 0644)
+	r = newRingBuffer(fileFmt, 3)
+	if name, _ := r.next(); name != r.fileName(0) {
+		t.Errorf("'%v' is expected, but got '%v'.", r.fileName(0), name)
+	}
+}
+
+func TestWriterRingBuffer(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic.pcap")
+	c.Rcap.RingFiles = 2
+	c.Rcap.MaxFilePackets = 1
+	if err := c.CheckAndFormat(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+
+	// Rotated by time and by the number of packets.
+	for _, ts := range []int64{60, 60, 120} {
+		if err := w.Update(ts); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if err := w.WritePacket(capinfo, data); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+	}
+	w.Close()
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	if len(files) != 2 {
+		t.Errorf("2 files are expected, but got %v file(s).", len(files))
+	}
+	if slot, _ := w.ring.loadSlot(); slot != 0 {
+		t.Errorf("'0' is expected, but got '%v'.", slot)
+	}
+}
@@ -3,30 +3,57 @@ package rcap
 import (
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
 const (
 	// SamplingDump holds the number of packets to dump sampling results.
 	SamplingDump = 10000
+	// StatsInterval is the interval to get the statistics of libpcap.
+	StatsInterval = time.Second
+
+	// QueuePolicyBlock makes the capture wait until the queue has space (the
+	// kernel buffer holds packets meanwhile).
+	QueuePolicyBlock = "block"
+	// QueuePolicyDrop drops captured packets if the queue is full, so the
+	// kernel buffer never overflows because of slow writes.
+	QueuePolicyDrop = "drop"
 )
 
 type Runner struct {
 	config             *Config
-	reader             *Reader
-	writer             *Writer
+	readers            []*Reader
+	sinks              []*sink // Outputs of packets in the order of matching.
+	merger             *packetMerger
+	packets            chan *packet
+	done               chan struct{}
+	wg                 sync.WaitGroup
 	doExit             bool
 	doReload           bool
 	numStatsPackets    uint64 // num{Stats,Captured,Sampled}Packets are used to dump sampling results
 	numCapturedPackets uint64
 	numSampledPackets  uint64
+	sampler            sampler
+	limiter            *rateLimiter     // nil if no rate limit is set.
+	truncater          *packetTruncater // nil if no truncation rule is set.
+	anonymizer         *anonymizer      // nil if no anonymization is set.
+	numLimitedPackets  uint64
+	triggerBpfs        map[layers.LinkType]*pcap.BPF // nil if no trigger filter is set.
+	triggerRequested   int32                         // Set to 1 by SIGUSR2 or HTTP requests to fire the trigger.
+	flushRequested     int32                         // Set to 1 by signals to flush the buffers of the writers.
+	lastStatsTime      time.Time
+	numFinished        int // Number of readers which reached the end of files.
 }
 
 func NewRunner(c *Config) (*Runner, error) {
@@ -39,53 +66,288 @@ func NewRunner(c *Config) (*Runner, error) {
 		numSampledPackets:  0,
 	}
 
+	if err := r.setupStages(configChanges{sampler: true, rateLimiter: true}); err != nil {
+		return nil, err
+	}
+
 	return r, nil
 }
 
+// setupStages makes the stages applied to packets before they are written
+// (sampling, truncation, rate limiting and anonymization) from the config. The
+// sampler and the rate limiter are remade only if they are changed, so
+// reloading neither resets the sequence of sampling nor lets a burst of packets
+// through.
+func (r *Runner) setupStages(changes configChanges) error {
+	c := &r.config.Rcap
+
+	anonymizer, err := newAnonymizer(c)
+	if err != nil {
+		return err
+	}
+
+	if changes.sampler {
+		r.sampler = newSampler(c)
+	}
+	r.truncater = newPacketTruncater(c)
+	if changes.rateLimiter {
+		r.limiter = newRateLimiter(c)
+	}
+	r.anonymizer = anonymizer
+	return nil
+}
+
 func (r *Runner) Reload() error {
 	if r.config.Filename == "" {
 		err := errors.New("no config file is set.")
-		log.Printf("failed to reload config: %v", err)
+		slog.Error("failed to reload config", "error", err)
 		return err
 	}
 
 	newConfig, err := LoadConfig(r.config.Filename)
 	if err != nil {
-		log.Printf("failed to reload config: %v", err)
-		log.Println("use the previous config instead.")
+		slog.Error("failed to reload config, use the previous config instead.", "error", err)
 		return err
 	}
 
-	// TODO: re-init reader and writer only when configuration has changed.
-	r.Close()
+	// Reopen the readers and the writers only if their params are changed.
+	// They are reopened in the next loop of Run.
+	changes := diffConfig(&r.config.Rcap, &newConfig.Rcap)
+	if changes.readers {
+		r.Close()
+		changes.writers = true
+		changes.bpfRules = false
+	} else {
+		if changes.writers {
+			r.closeWriters()
+		}
+		if changes.bpfRules {
+			for i, rules := range bpfRules(&newConfig.Rcap) {
+				if i >= len(r.readers) {
+					continue
+				}
+				if err := r.readers[i].SetBpfRules(rules); err != nil {
+					slog.Error("failed to apply BPF rules, use the previous rules instead.",
+						"device", r.readers[i].Device().Name, "bpfRules", rules, "error", err)
+				}
+			}
+		}
+	}
+
+	if newConfig.Rcap.MetricsAddr != r.config.Rcap.MetricsAddr {
+		slog.Warn("metricsAddr is not changed until restart.", "metricsAddr", r.config.Rcap.MetricsAddr)
+	}
+	if newConfig.Rcap.TriggerAddr != r.config.Rcap.TriggerAddr {
+		slog.Warn("triggerAddr is not changed until restart.", "triggerAddr", r.config.Rcap.TriggerAddr)
+	}
 
-	log.Println("reload config and use the new config.")
 	r.config = newConfig
+	if err := r.setupStages(changes); err != nil {
+		// The config is already checked by LoadConfig.
+		slog.Error("failed to set up stages", "error", err)
+	}
+	if err := SetupLogger(&r.config.Rcap); err != nil {
+		slog.Error("failed to set up logger, use the previous logger instead.", "error", err)
+	}
+
+	slog.Info("reload config and use the new config.",
+		"reopenReaders", changes.readers, "reopenWriters", changes.writers, "applyBpfRules", changes.bpfRules)
 	r.config.PrintToLog()
 
 	return nil
 }
 
-func (r *Runner) setupReaderAndWriter() error {
-	var err error
+func (r *Runner) setupReaders() error {
+	if r.config.Rcap.OfflineMode() {
+		files, err := r.config.Rcap.ReadFileNames()
+		if err != nil {
+			return err
+		}
+		reader, err := NewFileReader(r.config, files)
+		if err != nil {
+			return err
+		}
+		r.readers = []*Reader{reader}
+		return nil
+	}
 
-	if r.reader == nil {
-		r.reader, err = NewReader(r.config)
+	for _, device := range r.config.Rcap.CaptureDevices() {
+		reader, err := NewReader(r.config, device)
 		if err != nil {
+			r.closeReaders()
 			return err
 		}
+		r.readers = append(r.readers, reader)
+	}
+
+	return nil
+}
+
+func (r *Runner) setupWriters() error {
+	var interfaces []captureInterface
+	for _, reader := range r.readers {
+		interfaces = append(interfaces, captureInterface{device: reader.Device(), linkType: reader.LinkType()})
 	}
 
-	if r.writer == nil {
-		// The current NewWriter returns no error.
-		r.writer, _ = NewWriter(r.config, r.reader.LinkType())
+	// The hook is shared by the writers to limit the number of commands.
+	hook := newHookRunner(&r.config.Rcap)
+	index := newManifestIndex(&r.config.Rcap)
+
+	// Reports of the writers start from the latest statistics.
+	setup := func(writer *Writer) {
+		writer.onRotate = r.reportStats
+		writer.statsBase = make(map[*Reader]statsSnapshot)
+		for _, reader := range r.readers {
+			writer.statsBase[reader] = reader.statsSnapshot()
+		}
+
+		// Packets are sampled by the Runner and then by the sink.
+		sampling := r.config.Rcap.Sampling * writer.config.Rcap.Sampling
+		manifests := newManifestWriter(&writer.config.Rcap, writer.interfaces, sampling, index)
+
+		if manifests != nil {
+			writer.onClose = func(f closedFile) {
+				// Hashing a large file takes time, so the manifest is written
+				// in background. The hook runs after it is written.
+				holdFile(f.name)
+				backgroundJobs.Add(1)
+				go func() {
+					defer backgroundJobs.Done()
+					defer releaseFile(f.name)
+					manifests.Write(f)
+					hook.Run(f)
+				}()
+			}
+		} else if hook != nil {
+			writer.onClose = hook.Run
+		}
+	}
+
+	r.triggerBpfs = nil
+	if r.config.Rcap.Trigger {
+		bpfs, err := compileFilter(r.config.Rcap.TriggerFilter, r.config.Rcap.SnapLen, interfaces)
+		if err != nil {
+			return fmt.Errorf("invalid BPF of trigger: '%v' (%w)", r.config.Rcap.TriggerFilter, err)
+		}
+		r.triggerBpfs = bpfs
+	}
+
+	sinkConfigs := r.config.Rcap.OutputSinks()
+	for i := range sinkConfigs {
+		s, err := newSink(r.config, &sinkConfigs[i], interfaces, setup)
+		if err != nil {
+			r.sinks = nil
+			return err
+		}
+		r.sinks = append(r.sinks, s)
 	}
 
 	return nil
 }
 
+func (r *Runner) setupReaderAndWriter() error {
+	if r.readers == nil {
+		if err := r.setupReaders(); err != nil {
+			return err
+		}
+	}
+
+	if r.sinks == nil {
+		if err := r.setupWriters(); err != nil {
+			return err
+		}
+	}
+
+	if r.done == nil {
+		r.startCapture()
+	}
+
+	return nil
+}
+
+// startCapture starts a goroutine per reader, which sends captured packets to
+// the Runner through the queue of QueueSize packets.
+func (r *Runner) startCapture() {
+	c := &r.config.Rcap
+
+	r.merger = newPacketMerger(len(r.readers))
+	r.packets = make(chan *packet, c.QueueSize)
+	r.done = make(chan struct{})
+	r.numFinished = 0
+
+	// Packets in pcap files are never dropped.
+	dropIfFull := c.QueuePolicy == QueuePolicyDrop && !c.OfflineMode()
+
+	for i, reader := range r.readers {
+		r.wg.Add(1)
+		go r.capture(i, reader, dropIfFull)
+	}
+}
+
+// capture reads packets from the reader until an unexpected error occurs or
+// the capture is stopped. If dropIfFull is true, packets are dropped when the
+// queue is full. Errors (e.g. timeouts) are never dropped.
+func (r *Runner) capture(index int, reader *Reader, dropIfFull bool) {
+	defer r.wg.Done()
+
+	for {
+		data, capinfo, pkterr := reader.ReadPacket()
+
+		p := &packet{index: index, capinfo: capinfo, err: pkterr}
+		if pkterr == nil {
+			// The data returned from ReadPacket is overwritten by the next call.
+			p.data = make([]byte, len(data))
+			copy(p.data, data)
+		}
+
+		if pkterr == nil && dropIfFull {
+			select {
+			case r.packets <- p:
+			case <-r.done:
+				return
+			default:
+				reader.addQueueDropped()
+				metrics.addQueueDropped(reader.Device().Name)
+			}
+			continue
+		}
+
+		select {
+		case r.packets <- p:
+		case <-r.done:
+			return
+		}
+
+		if pkterr != nil && !isTimeout(pkterr) {
+			return
+		}
+	}
+}
+
+// stopCapture stops the goroutines started by startCapture. The packets left
+// in the queue are moved to the merger.
+func (r *Runner) stopCapture() {
+	if r.done == nil {
+		return
+	}
+
+	close(r.done)
+	r.wg.Wait()
+	r.done = nil
+
+	for {
+		select {
+		case p := <-r.packets:
+			r.merger.Push(p, time.Now())
+		default:
+			return
+		}
+	}
+}
+
 func (r *Runner) getTimestamp(capinfo gopacket.CaptureInfo, pkterr error) int64 {
-	if r.config.Rcap.UseSystemTime {
+	// Packets in pcap files are always rotated by their timestamps.
+	if r.config.Rcap.UseSystemTime && !r.config.Rcap.OfflineMode() {
 		return time.Now().Unix()
 	}
 
@@ -96,23 +358,106 @@ func (r *Runner) getTimestamp(capinfo gopacket.CaptureInfo, pkterr error) int64
 	return capinfo.Timestamp.Unix()
 }
 
+// updateStats requests the statistics of libpcap of the readers every
+// StatsInterval, and updates the metrics with the latest ones.
+func (r *Runner) updateStats() {
+	now := time.Now()
+	if now.Sub(r.lastStatsTime) < StatsInterval {
+		return
+	}
+	r.lastStatsTime = now
+
+	metrics.setQueueLength(len(r.packets))
+
+	for _, reader := range r.readers {
+		reader.RequestStats()
+
+		stats, err := reader.Stats()
+		if err != nil {
+			// Statistics are not available (e.g. offline files).
+			continue
+		}
+		metrics.setPcapStats(reader.Device().Name,
+			uint64(stats.PacketsReceived), uint64(stats.PacketsDropped), uint64(stats.PacketsIfDropped))
+	}
+}
+
+// readersOf returns the readers whose packets are written by the writer.
+func (r *Runner) readersOf(writer *Writer) []*Reader {
+	for _, s := range r.sinks {
+		for i, w := range s.writers {
+			if w != writer {
+				continue
+			}
+			if len(s.writers) == 1 {
+				return r.readers
+			}
+			if i < len(r.readers) {
+				return r.readers[i : i+1]
+			}
+		}
+	}
+	return nil
+}
+
+// reportStats logs the statistics of the readers of the writer since the last
+// rotation, and warns if the drop ratio exceeds DropWarnRatio.
+func (r *Runner) reportStats(writer *Writer) {
+	threshold := r.config.Rcap.DropWarnRatio
+
+	for _, reader := range r.readersOf(writer) {
+		name := reader.Device().Name
+		_, err := reader.Stats()
+		hasStats := err == nil
+		report := writer.takeStatsReport(reader)
+
+		if report.queueDropped > 0 {
+			slog.Warn("packets are dropped because the queue is full", "device", name, "queueDropped", report.queueDropped)
+		}
+
+		if !hasStats {
+			slog.Info("stats", "device", name, "read", report.numPackets, "written", writer.NumPackets(),
+				"queueDropped", report.queueDropped)
+			continue
+		}
+
+		ratio := report.dropRatio()
+		slog.Info("stats", "device", name, "read", report.numPackets, "written", writer.NumPackets(),
+			"queueDropped", report.queueDropped, "received", report.received, "dropped", report.dropped,
+			"ifDropped", report.ifDropped, "dropRatio", ratio)
+
+		if threshold > 0 && ratio > threshold {
+			slog.Warn("drop ratio exceeds the threshold", "device", name, "dropRatio", ratio, "threshold", threshold)
+		}
+	}
+}
+
 func (r *Runner) printSamplingResult() {
 	var ratio float32
 	if r.numCapturedPackets == 0 {
 		ratio = 0.0
 	} else {
-		ratio = float32(r.numSampledPackets) / float32(r.numCapturedPackets) * 100
+		ratio = float32(r.numSampledPackets) / float32(r.numCapturedPackets)
 	}
 
-	log.Printf("sampling result: %v/%v (%.2f%%)\n", r.numSampledPackets, r.numCapturedPackets, ratio)
+	slog.Info("sampling result", "strategy", r.config.Rcap.SamplingStrategy,
+		"sampled", r.numSampledPackets, "captured", r.numCapturedPackets, "ratio", ratio,
+		"limited", r.numLimitedPackets)
 }
 
-func (r *Runner) doSampling() bool {
-	if !r.config.Rcap.SamplingMode {
+// doSampling returns true if the packet is kept by the sampler. The linktype
+// is used to decode flows of the packet. The sampling result (including
+// packets limited by doRateLimit) is printed every numStatsPackets packets.
+func (r *Runner) doSampling(data []byte, linkType layers.LinkType) bool {
+	c := &r.config.Rcap
+	if !c.SamplingMode && r.limiter == nil {
 		return true
 	}
 
-	sample := Random() < r.config.Rcap.Sampling
+	sample := true
+	if c.SamplingMode {
+		sample = r.sampler.Sample(data, linkType)
+	}
 
 	r.numCapturedPackets++
 	if sample {
@@ -123,11 +468,65 @@ func (r *Runner) doSampling() bool {
 		r.printSamplingResult()
 		r.numCapturedPackets = 0
 		r.numSampledPackets = 0
+		r.numLimitedPackets = 0
 	}
 
 	return sample
 }
 
+// doRateLimit returns true if the packet does not exceed the rate limits.
+func (r *Runner) doRateLimit(p *packet, linkType layers.LinkType) bool {
+	if r.limiter == nil {
+		return true
+	}
+
+	now := p.capinfo.Timestamp
+	if r.config.Rcap.UseSystemTime && !r.config.Rcap.OfflineMode() {
+		now = time.Now()
+	}
+
+	if !r.limiter.Allow(p.data, linkType, len(p.data), now) {
+		r.numLimitedPackets++
+		metrics.addRateLimited()
+		return false
+	}
+	return true
+}
+
+// fireTrigger starts (or extends) an event of the writers in the trigger mode.
+func (r *Runner) fireTrigger(now time.Time, source string) error {
+	if !r.config.Rcap.Trigger {
+		slog.Warn("ignore the trigger (the trigger mode is disabled)", "source", source)
+		return nil
+	}
+
+	slog.Info("trigger fired", "source", source, "time", now)
+	metrics.addTrigger()
+
+	for _, s := range r.sinks {
+		for _, writer := range s.writers {
+			if err := writer.Trigger(now); err != nil {
+				return fmt.Errorf("failed to start event: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTrigger fires the trigger if the packet matches the trigger filter.
+func (r *Runner) checkTrigger(p *packet, linkType layers.LinkType) error {
+	bpf := r.triggerBpfs[linkType]
+	if bpf == nil || !bpf.Matches(p.capinfo, p.data) {
+		return nil
+	}
+
+	now := p.capinfo.Timestamp
+	if r.config.Rcap.UseSystemTime && !r.config.Rcap.OfflineMode() {
+		now = time.Now()
+	}
+	return r.fireTrigger(now, "filter")
+}
+
 func (r *Runner) Run() error {
 	for !r.doExit {
 		if r.doReload {
@@ -140,73 +539,249 @@ func (r *Runner) Run() error {
 			return fmt.Errorf("failed to setup reader/writer: %w", err)
 		}
 
-		data, capinfo, pkterr := r.reader.ReadPacket()
-		currentTime := r.getTimestamp(capinfo, pkterr)
+		p := <-r.packets
+		r.merger.Push(p, time.Now())
+		r.updateStats()
 
-		if err := r.writer.Update(currentTime); err != nil {
-			return fmt.Errorf("failed to update writer: %w", err)
+		if atomic.SwapInt32(&r.triggerRequested, 0) == 1 {
+			if err := r.fireTrigger(time.Now(), "request"); err != nil {
+				return err
+			}
 		}
 
-		if pkterr != nil {
-			switch pkterr {
-			case pcap.NextErrorTimeoutExpired:
-				// Go to next loop.
-				// Do NOT log messages when it is timeouted.
-				continue
-			default:
-				// Return error (unexpected error).
-				return fmt.Errorf("failed to read packet: %w", pkterr)
+		if p.err == nil {
+			metrics.addPacketRead(r.readers[p.index].Device().Name)
+		} else if p.err == io.EOF {
+			// The reader reached the end of files.
+			r.numFinished++
+		} else if !isTimeout(p.err) {
+			// Return error (unexpected error).
+			return fmt.Errorf("failed to read packet: %w", p.err)
+		}
+
+		// The packets released by the merger are written before the writers
+		// are updated by the timeout, so they are written to the files of
+		// their time.
+		for q := r.merger.Pop(); q != nil; q = r.merger.Pop() {
+			if err := r.handlePacket(q); err != nil {
+				return err
+			}
+		}
+
+		if isTimeout(p.err) {
+			// Update writers by the system time and go to next loop.
+			// Do NOT log messages when it is timeouted.
+			currentTime := r.getTimestamp(p.capinfo, p.err)
+			for _, s := range r.sinks {
+				for _, writer := range s.writers {
+					if err := writer.Update(currentTime); err != nil {
+						return fmt.Errorf("failed to update writer: %w", err)
+					}
+				}
+			}
+		}
+
+		force := atomic.SwapInt32(&r.flushRequested, 0) == 1
+		if err := r.flushWriters(time.Now(), force); err != nil {
+			return err
+		}
+
+		// Exit when all readers reached the end of files.
+		if r.numFinished == len(r.readers) {
+			slog.Info("all packets are read.")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// flushWriters flushes the buffers of the writers every FlushInterval (or
+// anyway if force is true), and syncs their files if they are due.
+func (r *Runner) flushWriters(now time.Time, force bool) error {
+	for _, s := range r.sinks {
+		for _, writer := range s.writers {
+			if err := writer.flushIfDue(now, force); err != nil {
+				return fmt.Errorf("failed to flush writer: %w", err)
 			}
 		}
+	}
+	return nil
+}
 
-		if !r.doSampling() {
+// matchSinks returns the sinks which the packet matches and are sampled
+// from.
+func (r *Runner) matchSinks(p *packet, linkType layers.LinkType) []*sink {
+	var matched []*sink
+
+	for _, s := range r.sinks {
+		if !s.matches(p.capinfo, p.data, linkType) {
 			continue
 		}
+		if s.sample(p.data, linkType) {
+			matched = append(matched, s)
+		}
+		if !s.next {
+			break
+		}
+	}
+
+	return matched
+}
+
+// handlePacket writes the packet to the writers of its device of the matching
+// sinks.
+func (r *Runner) handlePacket(p *packet) error {
+	currentTime := r.getTimestamp(p.capinfo, nil)
+
+	// Writers are rotated even if the packet is not written to them.
+	for _, s := range r.sinks {
+		writer, _ := s.writerFor(p.index)
+		if err := writer.Update(currentTime); err != nil {
+			return fmt.Errorf("failed to update writer: %w", err)
+		}
+	}
+
+	linkType := r.readers[p.index].LinkType()
+
+	// The trigger fires before the packet is written, so the packet is
+	// written to the file of the event.
+	if err := r.checkTrigger(p, linkType); err != nil {
+		return err
+	}
+
+	sample := r.doSampling(p.data, linkType)
+	metrics.addSampling(sample)
+	if !sample {
+		return nil
+	}
+
+	// Sinks are matched against the original packet (e.g. before
+	// anonymization).
+	sinks := r.matchSinks(p, linkType)
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	// Payloads are truncated before the rate limits are applied, so the limit
+	// of bytes is applied to the bytes written.
+	if r.truncater != nil {
+		p.capinfo, p.data = r.truncater.Truncate(p.capinfo, p.data, linkType)
+	}
+
+	// Packets exceeding the rate limits are dropped before written.
+	if !r.doRateLimit(p, linkType) {
+		return nil
+	}
 
-		if err := r.writer.WritePacket(capinfo, data); err != nil {
-			return fmt.Errorf("failed to write packet: %w", err)
+	if r.anonymizer != nil {
+		p.data = r.anonymizer.Anonymize(p.data, linkType)
+	}
+
+	for _, s := range sinks {
+		writer, intfIndex := s.writerFor(p.index)
+		p.capinfo.InterfaceIndex = intfIndex
+		if err := writer.WritePacket(p.capinfo, p.data); err != nil {
+			return fmt.Errorf("failed to write packet to sink '%v': %w", s.name, err)
 		}
 	}
 
 	return nil
 }
 
+func (r *Runner) closeReaders() {
+	for _, reader := range r.readers {
+		reader.Close()
+		slog.Info("close reader", "device", reader.Device().Name)
+	}
+	r.readers = nil
+}
+
 func (r *Runner) Close() {
-	if r.reader != nil {
-		r.reader.Close()
-		r.reader = nil
-		log.Println("close reader.")
+	r.stopCapture()
+
+	// Write the packets left in the merger before closing writers.
+	if r.merger != nil && r.sinks != nil {
+		for _, p := range r.merger.Drain() {
+			if err := r.handlePacket(p); err != nil {
+				slog.Error("failed to write the remaining packet", "error", err)
+			}
+		}
 	}
-	if r.writer != nil {
-		r.writer.Close()
-		r.writer = nil
-		log.Println("close writer.")
+	r.merger = nil
+
+	if r.readers != nil {
+		r.closeReaders()
 	}
+	r.closeWriters()
+}
+
+// closeWriters closes the writers of the sinks.
+func (r *Runner) closeWriters() {
+	for _, s := range r.sinks {
+		s.close()
+		slog.Info("close writer", "sink", s.name)
+	}
+	r.sinks = nil
 }
 
 func Run(config *Config) error {
-	// The current NewRunner returns no error.
-	r, _ := NewRunner(config)
+	r, err := NewRunner(config)
+	if err != nil {
+		return err
+	}
 
 	// Trap signals.
-	log.Println("trap signals (send SIGHUP to reload, SIGINT or SIGTERM to exit).")
+	slog.Info("trap signals (send SIGHUP to reload, SIGUSR1 to reopen the log file, SIGUSR2 to fire the trigger, SIGINT or SIGTERM to exit).")
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		for {
 			s := <-sigc
-			log.Println("SIGNAL:", s)
+			slog.Info("receive signal", "signal", s.String())
+
+			// Buffered packets are written out on any signal (they are also
+			// written out when the writers are closed).
+			atomic.StoreInt32(&r.flushRequested, 1)
 
 			switch s {
-			case syscall.SIGHUP:
-				r.doReload = true
+			case syscall.SIGHUP, syscall.SIGUSR1:
+				// Reopen the log file (e.g. rotated by logrotate).
+				if err := ReopenLogFile(); err != nil {
+					slog.Error("failed to reopen the log file", "error", err)
+				}
+				if s == syscall.SIGHUP {
+					r.doReload = true
+				}
+			case syscall.SIGUSR2:
+				atomic.StoreInt32(&r.triggerRequested, 1)
 			case syscall.SIGINT, syscall.SIGTERM:
 				r.doExit = true
 			}
 		}
 	}()
 
+	if addr := config.Rcap.MetricsAddr; addr != "" {
+		stop, err := startMetricsServer(addr, metrics)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		defer stop()
+	}
+
+	if addr := config.Rcap.TriggerAddr; addr != "" {
+		// The trigger is ignored unless the trigger mode is enabled (it may be
+		// enabled by reloading).
+		stop, err := startTriggerServer(addr, &r.triggerRequested)
+		if err != nil {
+			return fmt.Errorf("failed to start trigger server: %w", err)
+		}
+		defer stop()
+	}
+
+	// Wait for background jobs after closing the runner.
+	defer backgroundJobs.Wait()
 	defer r.Close()
 
 	return r.Run()
@@ -2,13 +2,26 @@ package rcap
 
 import (
 	"errors"
+	"io"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 )
 
+// make Reader which reads testdata/sample.pcap.
+func makeSampleReader(t *testing.T, c *Config) *Reader {
+	reader, err := openAndSetUpReader(c, c.Rcap.CaptureDevices()[0], "testdata/sample.pcap")
+	if err != nil {
+		t.Fatalf("failed to make Reader for test: %v", err)
+	}
+	return reader
+}
+
 func TestNewRunner(t *testing.T) {
 	c := makeConfig()
 	_, err := NewRunner(c)
@@ -61,10 +74,11 @@ func TestRunnerSetupReaderAndWriter(t *testing.T) {
 	}
 
 	// NewReader and NewWriter succeed (reader is a dummy).
-	r.reader, _ = openAndSetUpReader(c, "testdata/sample.pcap")
+	r.readers = []*Reader{makeSampleReader(t, c)}
 	if err := r.setupReaderAndWriter(); err != nil {
 		t.Error("err is expected, but got 'nil'.")
 	}
+	r.Close()
 }
 
 func TestRunnerGetTimestamp(t *testing.T) {
@@ -119,7 +133,7 @@ func TestRunnerDoSamplingAll(t *testing.T) {
 
 	count := 0
 	for i := 0; i < 100; i++ {
-		if r.doSampling() {
+		if r.doSampling(nil, layers.LinkTypeEthernet) {
 			count++
 		}
 	}
@@ -139,7 +153,7 @@ func TestRunnerDoSampling10Percent(t *testing.T) {
 
 	count := 0
 	for i := 0; i < 100; i++ {
-		if r.doSampling() {
+		if r.doSampling(nil, layers.LinkTypeEthernet) {
 			count++
 		}
 	}
@@ -168,11 +182,62 @@ func TestRunnerRun(t *testing.T) {
 	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
 	c.CheckAndFormat()
 	r, _ := NewRunner(c)
-	r.reader, _ = openAndSetUpReader(c, "testdata/sample.pcap")
+	r.readers = []*Reader{makeSampleReader(t, c)}
 
-	// EOF error.
-	if err := r.Run(); err == nil {
-		t.Error("err is expected, but got 'nil'.")
+	// Exit at EOF without error.
+	if err := r.Run(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	r.Close()
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	if numFiles := len(files); numFiles != 1 {
+		t.Errorf("1 file is expected, but got %v file(s).", numFiles)
+	}
+}
+
+func TestRunnerRunMergeBeforeTimeout(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.Devices = []DeviceConfig{{Name: "any"}, {Name: "lo"}}
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Interval = 10
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c), makeSampleReader(t, c)}
+	if err := r.setupWriters(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	// The packet of the first device is held by the merger until the second
+	// device times out in the next rotation interval.
+	ts := time.Unix(time.Now().Unix()/10*10-20, 0)
+	data := []byte("data")
+	r.merger = newPacketMerger(2)
+	r.done = make(chan struct{})
+	r.packets = make(chan *packet, 4)
+	r.packets <- &packet{index: 0, data: data, capinfo: gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}}
+	r.packets <- &packet{index: 1, err: pcap.NextErrorTimeoutExpired}
+	r.packets <- &packet{index: 0, err: io.EOF}
+	r.packets <- &packet{index: 1, err: io.EOF}
+
+	if err := r.Run(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	r.done = nil
+	r.Close()
+
+	// The packet is written to the file of its time, which is rotated by the
+	// timeout after that.
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	sort.Strings(files)
+	if len(files) != 2 {
+		t.Fatalf("2 files are expected, but got %v file(s).", len(files))
+	}
+	// 24 bytes of the header and a packet of 20 bytes.
+	if size := fileSize(files[0], -1); size != 44 {
+		t.Errorf("'44' is expected, but got '%v'.", size)
 	}
 }
 
@@ -183,9 +248,10 @@ func TestRunnerClose(t *testing.T) {
 	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
 	c.CheckAndFormat()
 	r, _ := NewRunner(c)
-	r.reader, _ = openAndSetUpReader(c, "testdata/sample.pcap")
-	r.writer, _ = NewWriter(c, r.reader.LinkType())
-	r.writer.openWriter(0)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	w, _ := NewWriter(c, r.readers[0].LinkType())
+	w.openWriter(0)
+	r.sinks = []*sink{{name: DefaultSinkName, writers: []*Writer{w}}}
 
 	r.Close()
 }
@@ -200,3 +266,191 @@ func TestRun(t *testing.T) {
 		t.Errorf("err is expected, but got 'nil'.")
 	}
 }
+
+func TestRunnerSetupWriters(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.Devices = []DeviceConfig{{Name: "any"}, {Name: "lo"}}
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+	c.CheckAndFormat()
+
+	// Merged into one writer.
+	r, _ := NewRunner(c)
+	for _, device := range c.Rcap.CaptureDevices() {
+		reader, _ := openAndSetUpReader(c, device, "testdata/sample.pcap")
+		r.readers = append(r.readers, reader)
+	}
+	if err := r.setupWriters(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	writers := r.sinks[0].writers
+	if len(writers) != 1 {
+		t.Errorf("1 writer is expected, but got %v writer(s).", len(writers))
+	}
+	if w, index := r.sinks[0].writerFor(1); w != writers[0] || index != 1 {
+		t.Errorf("the first writer and index 1 are expected, but got index %v.", index)
+	}
+
+	// Split by device.
+	c.Rcap.FileFmt = filepath.Join(tempDir, "%i", "traffic-%Y%m%d-%H%M%S.pcap")
+	r.sinks = nil
+	if err := r.setupWriters(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	writers = r.sinks[0].writers
+	if len(writers) != 2 {
+		t.Errorf("2 writers are expected, but got %v writer(s).", len(writers))
+	}
+	if w, index := r.sinks[0].writerFor(1); w != writers[1] || index != 0 {
+		t.Errorf("the second writer and index 0 are expected, but got index %v.", index)
+	}
+	if readers := r.readersOf(writers[1]); len(readers) != 1 || readers[0] != r.readers[1] {
+		t.Errorf("the second reader is expected, but got %v reader(s).", len(readers))
+	}
+
+	for i, name := range []string{"any", "lo"} {
+		writers[i].openWriter(0)
+		expected := filepath.Join(tempDir, name, "traffic-19700101-000000.pcap")
+		if got := writers[i].file.Name(); got != expected {
+			t.Errorf("'%v' is expected, but got '%v'.", expected, got)
+		}
+	}
+
+	r.Close()
+}
+
+func TestRunnerReportStats(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "traffic-%Y%m%d-%H%M%S.pcap")
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+
+	if readers := r.readersOf(r.sinks[0].writers[0]); len(readers) != 1 {
+		t.Errorf("1 reader is expected, but got %v reader(s).", len(readers))
+	}
+
+	// Statistics are not available for offline files, but packets are counted.
+	r.readers[0].ReadPacket()
+	r.reportStats(r.sinks[0].writers[0])
+	if base := r.sinks[0].writers[0].statsBase[r.readers[0]]; base.numPackets != 1 {
+		t.Errorf("'1' is expected, but got '%v'.", base.numPackets)
+	}
+
+	r.Close()
+}
+
+func TestRunnerReportStatsWithSinks(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.Sinks = []SinkConfig{
+		{Name: "a", Protocol: TruncateAny, FileFmt: filepath.Join(tempDir, "a.pcap"), Interval: 60, Sampling: 1.0},
+		{Name: "b", Protocol: TruncateAny, FileFmt: filepath.Join(tempDir, "b.pcap"), Interval: 60, Sampling: 1.0},
+	}
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+	reader := r.readers[0]
+	a, b := r.sinks[0].writers[0], r.sinks[1].writers[0]
+
+	// The report of a sink does not reset the counters of the other sink.
+	reader.numPackets = 2
+	if report := a.takeStatsReport(reader); report.numPackets != 2 {
+		t.Errorf("'2' is expected, but got '%v'.", report.numPackets)
+	}
+
+	reader.numPackets = 3
+	if report := b.takeStatsReport(reader); report.numPackets != 3 {
+		t.Errorf("'3' is expected, but got '%v'.", report.numPackets)
+	}
+	if report := a.takeStatsReport(reader); report.numPackets != 1 {
+		t.Errorf("'1' is expected, but got '%v'.", report.numPackets)
+	}
+
+	r.Close()
+}
+
+func TestRunnerCaptureDropIfFull(t *testing.T) {
+	c := makeConfig()
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	reader := makeSampleReader(t, c)
+	r.packets = make(chan *packet, 1)
+	r.done = make(chan struct{})
+
+	r.wg.Add(1)
+	go r.capture(0, reader, true)
+
+	// Packets are dropped while the queue is full, but the error at the end
+	// of the file is always sent.
+	numReceived := 0
+	for p := range r.packets {
+		if p.err != nil {
+			break
+		}
+		numReceived++
+	}
+	r.wg.Wait()
+
+	if got := uint64(numReceived) + reader.NumQueueDropped(); got != uint64(reader.NumPackets()) {
+		t.Errorf("'%v' is expected, but got '%v'.", reader.NumPackets(), got)
+	}
+
+	reader.Close()
+}
+
+func TestRunnerStopCapture(t *testing.T) {
+	c := makeConfig()
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.merger = newPacketMerger(1)
+	r.packets = make(chan *packet, 2)
+	r.done = make(chan struct{})
+
+	// Packets left in the queue are moved to the merger.
+	r.packets <- makePacket(0, 100)
+	r.packets <- makePacket(0, 101)
+	r.stopCapture()
+
+	if r.done != nil || len(r.packets) != 0 || r.merger.Len() != 2 {
+		t.Errorf("2 packets in the merger are expected, but got %v packet(s).", r.merger.Len())
+	}
+
+	// No-op if the capture is not started.
+	r.stopCapture()
+}
+
+func TestRunOffline(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// 2 files which have packets for 3 minutes.
+	makePcapFile(t, filepath.Join(tempDir, "input", "a.pcap"), layers.LinkTypeEthernet, 86400, 90)
+	makePcapFile(t, filepath.Join(tempDir, "input", "b.pcap"), layers.LinkTypeEthernet, 86490, 90)
+
+	c := makeConfig()
+	c.Rcap.ReadFiles = []string{filepath.Join(tempDir, "input", "*.pcap")}
+	c.Rcap.FileFmt = filepath.Join(tempDir, "output", "traffic-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Interval = 60
+	if err := c.CheckAndFormat(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	if err := Run(c); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "output", "*.pcap"))
+	if numFiles := len(files); numFiles != 3 {
+		t.Errorf("3 files are expected, but got %v file(s).", numFiles)
+	}
+	if expected := filepath.Join(tempDir, "output", "traffic-19700102-000100.pcap"); !FileExists(expected) {
+		t.Errorf("'%v' is expected to exist.", expected)
+	}
+}
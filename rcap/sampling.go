@@ -0,0 +1,131 @@
+package rcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// SamplingRandom keeps each packet with the probability of Sampling.
+	SamplingRandom = "random"
+	// SamplingFlow keeps all packets of flows (5-tuples) sampled with the
+	// probability of Sampling. Both directions of a flow are sampled together.
+	SamplingFlow = "flow"
+	// SamplingNth keeps every Nth packet, where N is round(1 / Sampling).
+	SamplingNth = "nth"
+)
+
+// sampler decides whether a packet is kept or not.
+type sampler interface {
+	Sample(data []byte, linkType layers.LinkType) bool
+}
+
+// newSampler returns a sampler of the strategy of the config.
+func newSampler(c *RcapConfig) sampler {
+	switch c.SamplingStrategy {
+	case SamplingFlow:
+		return &flowSampler{rate: c.Sampling, seed: c.SamplingSeed}
+	case SamplingNth:
+		return newNthSampler(c.Sampling)
+	default:
+		return &randomSampler{rate: c.Sampling, rng: newRand(c.SamplingSeed)}
+	}
+}
+
+// randomSampler keeps packets at random.
+type randomSampler struct {
+	rate float64
+	rng  *rand.Rand
+}
+
+func (s *randomSampler) Sample(data []byte, linkType layers.LinkType) bool {
+	return s.rng.Float64() < s.rate
+}
+
+// nthSampler keeps the first packet of every N packets.
+type nthSampler struct {
+	every uint64 // 0 means no packets are kept.
+	count uint64
+}
+
+func newNthSampler(rate float64) *nthSampler {
+	s := &nthSampler{}
+	if rate > 0 {
+		s.every = uint64(math.Max(1, math.Round(1/rate)))
+	}
+	return s
+}
+
+func (s *nthSampler) Sample(data []byte, linkType layers.LinkType) bool {
+	if s.every == 0 {
+		return false
+	}
+
+	sample := s.count%s.every == 0
+	s.count++
+	return sample
+}
+
+// flowSampler keeps packets of flows whose hashes are less than the rate.
+// The same seed always samples the same flows.
+type flowSampler struct {
+	rate float64
+	seed int64
+}
+
+// flowKey returns the key of the flow of the packet, which is the same in both
+// directions. It returns nil if the packet has no network layer.
+func flowKey(data []byte, linkType layers.LinkType) []byte {
+	p := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	network := p.NetworkLayer()
+	if network == nil {
+		return nil
+	}
+
+	netFlow := network.NetworkFlow()
+	src, dst := netFlow.Src().Raw(), netFlow.Dst().Raw()
+
+	var srcPort, dstPort []byte
+	var proto gopacket.LayerType
+	if transport := p.TransportLayer(); transport != nil {
+		transportFlow := transport.TransportFlow()
+		srcPort, dstPort = transportFlow.Src().Raw(), transportFlow.Dst().Raw()
+		proto = transport.LayerType()
+	}
+
+	// Order the endpoints so that both directions have the same key.
+	if c := bytes.Compare(src, dst); c > 0 || (c == 0 && bytes.Compare(srcPort, dstPort) > 0) {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	var key []byte
+	key = binary.BigEndian.AppendUint32(key, uint32(network.LayerType()))
+	key = binary.BigEndian.AppendUint32(key, uint32(proto))
+	for _, b := range [][]byte{src, srcPort, dst, dstPort} {
+		key = append(key, byte(len(b)))
+		key = append(key, b...)
+	}
+	return key
+}
+
+func (s *flowSampler) Sample(data []byte, linkType layers.LinkType) bool {
+	key := flowKey(data, linkType)
+	if key == nil {
+		// Packets without flows (e.g. ARP) are sampled by their contents.
+		key = data
+	}
+
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, s.seed)
+	h.Write(key)
+
+	return float64(h.Sum64())/math.Pow(2, 64) < s.rate
+}
@@ -0,0 +1,148 @@
+package rcap
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// makeTCPPacket returns an Ethernet frame of a TCP packet.
+func makeTCPPacket(t *testing.T, srcIP string, srcPort int, dstIP string, dstPort int) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort)}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload("data")); err != nil {
+		t.Fatalf("failed to make packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFlowKey(t *testing.T) {
+	a := makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80)
+	b := makeTCPPacket(t, "198.51.100.1", 80, "192.0.2.1", 12345)
+	c := makeTCPPacket(t, "192.0.2.1", 12346, "198.51.100.1", 80)
+
+	keyA := string(flowKey(a, layers.LinkTypeEthernet))
+	keyB := string(flowKey(b, layers.LinkTypeEthernet))
+	keyC := string(flowKey(c, layers.LinkTypeEthernet))
+
+	if keyA == "" {
+		t.Fatalf("a key is expected, but got nil.")
+	}
+	if keyA != keyB {
+		t.Errorf("both directions are expected to have the same key, but got '%x' and '%x'.", keyA, keyB)
+	}
+	if keyA == keyC {
+		t.Errorf("different flows are expected to have different keys, but got '%x'.", keyA)
+	}
+
+	if key := flowKey([]byte("not a packet"), layers.LinkTypeEthernet); key != nil {
+		t.Errorf("nil is expected, but got '%x'.", key)
+	}
+}
+
+func TestFlowSampler(t *testing.T) {
+	s := &flowSampler{rate: 0.5, seed: 1}
+
+	numSampled := 0
+	for port := 10000; port < 11000; port++ {
+		request := makeTCPPacket(t, "192.0.2.1", port, "198.51.100.1", 80)
+		response := makeTCPPacket(t, "198.51.100.1", 80, "192.0.2.1", port)
+
+		sample := s.Sample(request, layers.LinkTypeEthernet)
+		if s.Sample(response, layers.LinkTypeEthernet) != sample {
+			t.Fatalf("both directions of a flow are expected to be sampled together (port: %v).", port)
+		}
+		// Same flow, same result.
+		if s.Sample(request, layers.LinkTypeEthernet) != sample {
+			t.Fatalf("the same result is expected for the same flow (port: %v).", port)
+		}
+		if sample {
+			numSampled++
+		}
+	}
+
+	if numSampled < 400 || numSampled > 600 {
+		t.Errorf("about 500 flows are expected to be sampled, but got %v.", numSampled)
+	}
+
+	for _, rate := range []float64{0.0, 1.0} {
+		s := &flowSampler{rate: rate}
+		data := makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80)
+		if got := s.Sample(data, layers.LinkTypeEthernet); got != (rate == 1.0) {
+			t.Errorf("'%v' is expected, but got '%v' (rate: %v).", rate == 1.0, got, rate)
+		}
+	}
+}
+
+func TestNthSampler(t *testing.T) {
+	cases := []struct {
+		rate     float64
+		expected []bool
+	}{
+		{1.0, []bool{true, true, true, true}},
+		{0.5, []bool{true, false, true, false}},
+		{0.3, []bool{true, false, false, true}},
+		{0.0, []bool{false, false, false, false}},
+	}
+
+	for _, c := range cases {
+		s := newNthSampler(c.rate)
+		for i, expected := range c.expected {
+			if got := s.Sample(nil, layers.LinkTypeEthernet); got != expected {
+				t.Errorf("'%v' is expected, but got '%v' (rate: %v, i: %v).", expected, got, c.rate, i)
+			}
+		}
+	}
+}
+
+func TestRandomSamplerSeed(t *testing.T) {
+	c := makeConfig()
+	c.Rcap.Sampling = 0.5
+	c.Rcap.SamplingSeed = 42
+
+	s1, s2 := newSampler(&c.Rcap), newSampler(&c.Rcap)
+	for i := 0; i < 100; i++ {
+		if s1.Sample(nil, layers.LinkTypeEthernet) != s2.Sample(nil, layers.LinkTypeEthernet) {
+			t.Fatalf("the same results are expected with the same seed (i: %v).", i)
+		}
+	}
+}
+
+func TestNewSampler(t *testing.T) {
+	cases := []struct {
+		strategy string
+		expected string
+	}{
+		{SamplingRandom, "*rcap.randomSampler"},
+		{SamplingFlow, "*rcap.flowSampler"},
+		{SamplingNth, "*rcap.nthSampler"},
+	}
+
+	for _, c := range cases {
+		config := makeConfig()
+		config.Rcap.SamplingStrategy = c.strategy
+
+		got := fmt.Sprintf("%T", newSampler(&config.Rcap))
+		if got != c.expected {
+			t.Errorf("'%v' is expected, but got '%v'.", c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package rcap
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// DefaultSinkName is the name of the sink made from FileFmt and Interval if
+// no sinks are configured.
+const DefaultSinkName = "default"
+
+// sink is a named output of packets. Packets matching the filter and the
+// protocol of the sink are sampled and written to its writers.
+type sink struct {
+	name     string
+	config   *Config                       // Config of the writers (FileFmt and Interval of the sink).
+	bpfs     map[layers.LinkType]*pcap.BPF // Compiled filter per linktype (nil if no filter).
+	protocol string
+	ports    []uint
+	next     bool      // Match packets against the following sinks too.
+	sampler  sampler   // nil if all packets are kept.
+	writers  []*Writer // One writer per reader if split by device, otherwise one writer.
+}
+
+// sinkConfigOf returns a copy of the config whose output params are replaced
+// with the ones of the sink.
+func sinkConfigOf(c *Config, sc *SinkConfig) *Config {
+	config := *c
+	config.Rcap.FileFmt = sc.FileFmt
+	config.Rcap.Interval = sc.Interval
+	config.Rcap.Sampling = sc.Sampling
+	config.Rcap.SamplingMode = (sc.Sampling < 1.0)
+	config.Rcap.SamplingStrategy = sc.SamplingStrategy
+	return &config
+}
+
+// newSink returns a new instance of sink which writes packets captured on the
+// interfaces. setup is called for each writer of the sink.
+func newSink(c *Config, sc *SinkConfig, interfaces []captureInterface, setup func(*Writer)) (*sink, error) {
+	config := sinkConfigOf(c, sc)
+
+	s := &sink{
+		name:     sc.Name,
+		config:   config,
+		protocol: sc.Protocol,
+		ports:    sc.Ports,
+		next:     sc.Continue,
+	}
+
+	bpfs, err := compileFilter(sc.Filter, c.Rcap.SnapLen, interfaces)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BPF of sink '%v': '%v' (%w)", sc.Name, sc.Filter, err)
+	}
+	s.bpfs = bpfs
+
+	if config.Rcap.SamplingMode {
+		s.sampler = newSampler(&config.Rcap)
+	}
+
+	if !config.Rcap.SplitByDevice() {
+		writer, err := newWriter(config, interfaces)
+		if err != nil {
+			return nil, err
+		}
+		setup(writer)
+		s.writers = []*Writer{writer}
+		return s, nil
+	}
+
+	for _, intf := range interfaces {
+		writer, err := newWriter(config, []captureInterface{intf})
+		if err != nil {
+			return nil, err
+		}
+		setup(writer)
+		s.writers = append(s.writers, writer)
+	}
+
+	return s, nil
+}
+
+// compileFilter compiles the BPF rules for each linktype of the interfaces
+// to match packets in userspace. It returns nil if the rules are empty.
+func compileFilter(filter string, snapLen uint, interfaces []captureInterface) (map[layers.LinkType]*pcap.BPF, error) {
+	if filter == "" {
+		return nil, nil
+	}
+
+	bpfs := make(map[layers.LinkType]*pcap.BPF)
+	for _, intf := range interfaces {
+		if _, ok := bpfs[intf.linkType]; ok {
+			continue
+		}
+		bpf, err := pcap.NewBPF(intf.linkType, int(snapLen), filter)
+		if err != nil {
+			return nil, err
+		}
+		bpfs[intf.linkType] = bpf
+	}
+	return bpfs, nil
+}
+
+// writerFor returns the writer and the interface index for the device.
+func (s *sink) writerFor(index int) (*Writer, int) {
+	if len(s.writers) == 1 {
+		return s.writers[0], index
+	}
+	return s.writers[index], 0
+}
+
+// matches returns true if the packet matches the filter and the protocol of
+// the sink.
+func (s *sink) matches(capinfo gopacket.CaptureInfo, data []byte, linkType layers.LinkType) bool {
+	if bpf := s.bpfs[linkType]; bpf != nil && !bpf.Matches(capinfo, data) {
+		return false
+	}
+
+	if s.protocol == TruncateAny && len(s.ports) == 0 {
+		return true
+	}
+
+	d, ok := decodeForTruncation(data, linkType)
+	if !ok {
+		return false
+	}
+	return matchProtocol(s.protocol, s.ports, d)
+}
+
+// sample returns true if the packet is kept by the sampler of the sink.
+func (s *sink) sample(data []byte, linkType layers.LinkType) bool {
+	return s.sampler == nil || s.sampler.Sample(data, linkType)
+}
+
+// close closes the writers of the sink.
+func (s *sink) close() {
+	for _, writer := range s.writers {
+		writer.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package rcap
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSinkMatches(t *testing.T) {
+	c := makeConfig()
+	interfaces := makeInterfaces(layers.LinkTypeEthernet)
+	setup := func(*Writer) {}
+
+	udp53 := makeUDPPacket(t, 12345, 53, nil)
+	udp54 := makeUDPPacket(t, 12345, 54, nil)
+	tcp53 := makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 53)
+	capinfo := gopacket.CaptureInfo{CaptureLength: len(udp53), Length: len(udp53)}
+
+	cases := []struct {
+		sink     SinkConfig
+		data     []byte
+		expected bool
+	}{
+		{SinkConfig{Protocol: TruncateAny}, []byte("data"), true},
+		{SinkConfig{Protocol: TruncateAny, Ports: []uint{53}}, []byte("data"), false},
+		{SinkConfig{Protocol: TruncateUDP, Ports: []uint{53}}, udp53, true},
+		{SinkConfig{Protocol: TruncateUDP, Ports: []uint{53}}, udp54, false},
+		{SinkConfig{Protocol: TruncateUDP, Ports: []uint{53}}, tcp53, false},
+		{SinkConfig{Protocol: TruncateDNS}, udp53, true},
+		{SinkConfig{Protocol: TruncateTCP, Filter: "ip"}, tcp53, true},
+	}
+
+	for _, tc := range cases {
+		tc.sink.Name = "test"
+		tc.sink.FileFmt = filepath.Join(t.TempDir(), "traffic.pcap")
+		s, err := newSink(c, &tc.sink, interfaces, setup)
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if got := s.matches(capinfo, tc.data, layers.LinkTypeEthernet); got != tc.expected {
+			t.Errorf("%+v: '%v' is expected, but got '%v'.", tc.sink, tc.expected, got)
+		}
+	}
+
+	// Invalid BPF.
+	sc := &SinkConfig{Name: "test", Protocol: TruncateAny, Filter: "(invalid", FileFmt: "traffic.pcap"}
+	if _, err := newSink(c, sc, interfaces, setup); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.SamplingStrategy = SamplingNth
+	c.CheckAndFormat()
+	interfaces := makeInterfaces(layers.LinkTypeEthernet, layers.LinkTypeEthernet)
+
+	numSetup := 0
+	setup := func(*Writer) { numSetup++ }
+
+	sc := &SinkConfig{
+		Name:             "test",
+		Protocol:         TruncateAny,
+		FileFmt:          filepath.Join(tempDir, "%i", "traffic.pcap"),
+		Interval:         300,
+		Sampling:         0.5,
+		SamplingStrategy: SamplingNth,
+	}
+	s, err := newSink(c, sc, interfaces, setup)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	if len(s.writers) != 2 || numSetup != 2 {
+		t.Errorf("2 writers are expected, but got %v writer(s) (%v setup).", len(s.writers), numSetup)
+	}
+	if s.config.Rcap.Interval != 300 || !s.config.Rcap.SamplingMode {
+		t.Errorf("the config of the sink is expected, but got '%+v'.", s.config.Rcap)
+	}
+	if c.Rcap.Interval != 60 || c.Rcap.SamplingMode {
+		t.Errorf("the global config is expected not to be changed, but got '%+v'.", c.Rcap)
+	}
+
+	// Every 2nd packet is kept.
+	for i, expected := range []bool{true, false, true, false} {
+		if got := s.sample(nil, layers.LinkTypeEthernet); got != expected {
+			t.Errorf("%v: '%v' is expected, but got '%v'.", i, expected, got)
+		}
+	}
+}
+
+func TestRunnerHandlePacketWithSinks(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.Sinks = []SinkConfig{
+		{Name: "dns", Protocol: TruncateUDP, Ports: []uint{53}, FileFmt: filepath.Join(tempDir, "dns.pcap"), Interval: 60, Sampling: 1.0, Continue: true},
+		{Name: "tcp", Protocol: TruncateTCP, FileFmt: filepath.Join(tempDir, "tcp.pcap"), Interval: 60, Sampling: 1.0},
+		{Name: "others", Protocol: TruncateAny, FileFmt: filepath.Join(tempDir, "others.pcap"), Interval: 60, Sampling: 1.0},
+	}
+	if err := c.CheckAndFormat(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	if err := r.setupWriters(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	for _, data := range [][]byte{
+		makeUDPPacket(t, 12345, 53, nil),
+		makeUDPPacket(t, 12345, 54, nil),
+		makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80),
+		[]byte("data"),
+	} {
+		capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}
+		if err := r.handlePacket(&packet{index: 0, capinfo: capinfo, data: data}); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+	}
+
+	// DNS is written to "dns" and "others" (continue), TCP to "tcp" only.
+	for i, expected := range []uint{1, 1, 3} {
+		s := r.sinks[i]
+		if got := s.writers[0].NumPackets(); got != expected {
+			t.Errorf("%v: '%v' is expected, but got '%v'.", s.name, expected, got)
+		}
+	}
+
+	r.Close()
+}
@@ -0,0 +1,152 @@
+package rcap
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// TriggerPath is the path of the HTTP endpoint to fire the trigger (POST).
+	TriggerPath = "/trigger"
+)
+
+// bufferedPacket is a packet kept in memory until the trigger fires.
+type bufferedPacket struct {
+	capinfo gopacket.CaptureInfo
+	data    []byte
+}
+
+// triggerBuffer keeps the packets of the last preDuration (and preBytes at
+// most) in memory. When the trigger fires, the packets are written to a new
+// file with the packets until postDuration after the trigger.
+type triggerBuffer struct {
+	preDuration  time.Duration
+	preBytes     int64 // 0 means no limit.
+	postDuration time.Duration
+	packets      []bufferedPacket
+	numBytes     int64
+	end          time.Time // End of the current event.
+}
+
+func newTriggerBuffer(c *RcapConfig) *triggerBuffer {
+	return &triggerBuffer{
+		preDuration:  c.TriggerPre,
+		preBytes:     c.TriggerPreBytes,
+		postDuration: c.TriggerPost,
+	}
+}
+
+// evict removes the packets older than preDuration before the time, and the
+// oldest packets over preBytes.
+func (b *triggerBuffer) evict(now time.Time) {
+	start := now.Add(-b.preDuration)
+
+	i := 0
+	for ; i < len(b.packets); i++ {
+		p := &b.packets[i]
+		if !p.capinfo.Timestamp.Before(start) && (b.preBytes == 0 || b.numBytes <= b.preBytes) {
+			break
+		}
+		b.numBytes -= int64(len(p.data))
+	}
+
+	// Release the references to the data of the removed packets.
+	for j := 0; j < i; j++ {
+		b.packets[j] = bufferedPacket{}
+	}
+	b.packets = b.packets[i:]
+}
+
+// push keeps a copy of the packet.
+func (b *triggerBuffer) push(capinfo gopacket.CaptureInfo, data []byte) {
+	p := bufferedPacket{capinfo: capinfo, data: make([]byte, len(data))}
+	copy(p.data, data)
+
+	b.packets = append(b.packets, p)
+	b.numBytes += int64(len(p.data))
+	b.evict(capinfo.Timestamp)
+}
+
+// take returns the packets within preDuration before the time and clears the
+// buffer.
+func (b *triggerBuffer) take(now time.Time) []bufferedPacket {
+	b.evict(now)
+	packets := b.packets
+	b.packets = nil
+	b.numBytes = 0
+	return packets
+}
+
+// Trigger starts an event at the time, which writes the packets kept in memory
+// to a new file named by the time. If an event is in progress, it is extended
+// until postDuration after the time.
+func (w *Writer) Trigger(now time.Time) error {
+	t := w.trigger
+	end := now.Add(t.postDuration)
+
+	if w.file != nil {
+		if end.After(t.end) {
+			t.end = end
+		}
+		return nil
+	}
+
+	if err := w.openWriterWithAppend(now.Unix(), false); err != nil {
+		return err
+	}
+	t.end = end
+
+	packets := t.take(now)
+	slog.Info("start the event", "file", w.currentFileName(), "bufferedPackets", len(packets), "end", t.end)
+
+	for _, p := range packets {
+		if err := w.WritePacket(p.capinfo, p.data); err != nil {
+			return err
+		}
+	}
+
+	w.applyRetention()
+	return nil
+}
+
+// updateTrigger closes the file of the event if it ends at the timestamp.
+func (w *Writer) updateTrigger(ts int64) error {
+	if w.file == nil || time.Unix(ts, 0).Before(w.trigger.end) {
+		return nil
+	}
+
+	slog.Info("end the event", "file", w.currentFileName(), "packets", w.numPackets, "bytes", w.numBytes)
+	if w.onRotate != nil {
+		w.onRotate(w)
+	}
+	return w.Close()
+}
+
+// startTriggerServer starts an HTTP server which fires the trigger on POST
+// requests to TriggerPath in background, and returns a function to stop it.
+// The endpoint has no authentication, so it is served on its own address
+// (TriggerAddr) apart from the metrics.
+func startTriggerServer(addr string, requested *int32) (func(), error) {
+	return startHTTPServer(addr, TriggerPath, &triggerHandler{requested: requested})
+}
+
+// triggerHandler fires the trigger on POST requests.
+type triggerHandler struct {
+	requested *int32 // Set to 1 when the trigger is requested.
+}
+
+func (h *triggerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	atomic.StoreInt32(h.requested, 1)
+	slog.Info("receive trigger request", "remote", req.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+}
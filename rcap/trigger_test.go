@@ -0,0 +1,181 @@
+package rcap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func makeCaptureInfo(ts time.Time, size int) gopacket.CaptureInfo {
+	return gopacket.CaptureInfo{Timestamp: ts, CaptureLength: size, Length: size}
+}
+
+func TestTriggerBuffer(t *testing.T) {
+	c := makeConfig()
+	c.Rcap.TriggerPre = 3 * time.Second
+	c.Rcap.TriggerPreBytes = 0
+	b := newTriggerBuffer(&c.Rcap)
+
+	data := []byte("data")
+	for i := 0; i < 10; i++ {
+		b.push(makeCaptureInfo(time.Unix(int64(100+i), 0), len(data)), data)
+	}
+
+	// Packets at 106, 107, 108 and 109 are kept.
+	if len(b.packets) != 4 || b.numBytes != 16 {
+		t.Errorf("4 packets (16 bytes) are expected, but got %v packets (%v bytes).", len(b.packets), b.numBytes)
+	}
+
+	// Packets at 108 and 109 are taken.
+	packets := b.take(time.Unix(111, 0))
+	if len(packets) != 2 || packets[0].capinfo.Timestamp.Unix() != 108 {
+		t.Errorf("2 packets from 108 are expected, but got %v packets.", len(packets))
+	}
+	if len(b.packets) != 0 || b.numBytes != 0 {
+		t.Errorf("the empty buffer is expected, but got %v packets (%v bytes).", len(b.packets), b.numBytes)
+	}
+
+	// The oldest packets are removed over preBytes.
+	b.preBytes = 10
+	for i := 0; i < 3; i++ {
+		b.push(makeCaptureInfo(time.Unix(200, 0), len(data)), data)
+	}
+	if len(b.packets) != 2 || b.numBytes != 8 {
+		t.Errorf("2 packets (8 bytes) are expected, but got %v packets (%v bytes).", len(b.packets), b.numBytes)
+	}
+}
+
+func TestWriterTrigger(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "event-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Trigger = true
+	c.Rcap.TriggerPre = 2 * time.Second
+	c.Rcap.TriggerPost = 3 * time.Second
+	c.CheckAndFormat()
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+
+	var closed []closedFile
+	w.onClose = func(f closedFile) { closed = append(closed, f) }
+
+	data := []byte("data")
+	write := func(ts int64) {
+		if err := w.Update(ts); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if err := w.WritePacket(makeCaptureInfo(time.Unix(ts, 0), len(data)), data); err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+	}
+
+	// No files are made before the trigger.
+	for ts := int64(100); ts < 105; ts++ {
+		write(ts)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap")); len(files) != 0 {
+		t.Errorf("no files are expected, but got %v file(s).", len(files))
+	}
+
+	// Packets at 103 and 104 are written, and the event is extended to 109.
+	if err := w.Trigger(time.Unix(105, 0)); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if err := w.Trigger(time.Unix(106, 0)); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	for ts := int64(105); ts < 112; ts++ {
+		write(ts)
+	}
+
+	if len(closed) != 1 {
+		t.Fatalf("1 closed file is expected, but got %v file(s).", len(closed))
+	}
+	expected := filepath.Join(tempDir, "event-19700101-000145.pcap")
+	if f := closed[0]; f.name != expected || f.numPackets != 6 || f.start.Unix() != 103 || f.end.Unix() != 108 {
+		t.Errorf("'%v' with 6 packets from 103 to 108 is expected, but got '%+v'.", expected, f)
+	}
+
+	// Packets after the event are kept in memory again.
+	if w.file != nil || len(w.trigger.packets) != 3 {
+		t.Errorf("no files and 3 packets in memory are expected, but got %v packets.", len(w.trigger.packets))
+	}
+
+	w.Close()
+}
+
+func TestRunnerCheckTrigger(t *testing.T) {
+	tempDir := t.TempDir()
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "event-%Y%m%d-%H%M%S.pcap")
+	c.CheckAndFormat()
+
+	r, _ := NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	r.setupWriters()
+
+	data := makeUDPPacket(t, 12345, 53, nil)
+	p := &packet{index: 0, capinfo: makeCaptureInfo(time.Unix(100, 0), len(data)), data: data}
+
+	// The trigger mode is disabled.
+	if err := r.checkTrigger(p, layers.LinkTypeEthernet); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if err := r.fireTrigger(time.Unix(100, 0), "test"); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	r.Close()
+
+	c.Rcap.Trigger = true
+	c.Rcap.TriggerFilter = "udp port 53"
+	r, _ = NewRunner(c)
+	r.readers = []*Reader{makeSampleReader(t, c)}
+	if err := r.setupWriters(); err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	if err := r.handlePacket(p); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	writer := r.sinks[0].writers[0]
+	if writer.file == nil || writer.NumPackets() != 1 {
+		t.Errorf("the file of the event with 1 packet is expected, but got %v packets.", writer.NumPackets())
+	}
+
+	r.Close()
+}
+
+func TestStartTriggerServer(t *testing.T) {
+	var requested int32
+	stop, err := startTriggerServer("127.0.0.1:0", &requested)
+	if err != nil {
+		t.Fatalf("no error is expected, but got '%v'.", err)
+	}
+	stop()
+
+	if _, err := startTriggerServer("invalid-address", &requested); err == nil {
+		t.Errorf("err is expected, but got 'nil'.")
+	}
+}
+
+func TestTriggerHandler(t *testing.T) {
+	var requested int32
+	h := &triggerHandler{requested: &requested}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", TriggerPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed || requested != 0 {
+		t.Errorf("'%v' is expected, but got '%v'.", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", TriggerPath, nil))
+	if rec.Code != http.StatusAccepted || requested != 1 {
+		t.Errorf("'%v' is expected, but got '%v'.", http.StatusAccepted, rec.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package rcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// TruncateAny matches any packets.
+	TruncateAny = "any"
+	// TruncateTCP matches TCP packets.
+	TruncateTCP = "tcp"
+	// TruncateUDP matches UDP packets.
+	TruncateUDP = "udp"
+	// TruncateICMP matches ICMPv4 and ICMPv6 packets.
+	TruncateICMP = "icmp"
+	// TruncateDNS matches DNS packets (decoded by their ports).
+	TruncateDNS = "dns"
+	// TruncateTLS matches TLS packets (decoded by their ports, e.g. 443).
+	TruncateTLS = "tls"
+)
+
+// packetTruncater truncates payloads of packets by the first matching rule.
+// Headers (up to the transport layer) are always kept.
+type packetTruncater struct {
+	rules []TruncateRule
+}
+
+// newPacketTruncater returns a new instance of packetTruncater, or nil if no
+// rules are configured.
+func newPacketTruncater(c *RcapConfig) *packetTruncater {
+	if len(c.Truncate) == 0 {
+		return nil
+	}
+	return &packetTruncater{rules: c.Truncate}
+}
+
+// decodedPacket holds the layers of a packet used for truncation.
+type decodedPacket struct {
+	transport gopacket.Layer // nil if no transport layer.
+	appType   gopacket.LayerType
+	isICMP    bool
+	srcPort   uint
+	dstPort   uint
+	headerLen int // Length of headers up to the transport (or network) layer.
+}
+
+// nextLayerTyper is a layer which knows the type of the next layer (e.g. TCP
+// decides it by the ports).
+type nextLayerTyper interface {
+	NextLayerType() gopacket.LayerType
+}
+
+// decodeForTruncation decodes the packet. It returns false if the packet has
+// no network layer.
+func decodeForTruncation(data []byte, linkType layers.LinkType) (*decodedPacket, bool) {
+	p := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	d := &decodedPacket{}
+	hasNetwork := false
+	networkEnd := 0
+
+	for _, layer := range p.Layers() {
+		switch l := layer.(type) {
+		case *layers.TCP:
+			d.srcPort, d.dstPort = uint(l.SrcPort), uint(l.DstPort)
+		case *layers.UDP:
+			d.srcPort, d.dstPort = uint(l.SrcPort), uint(l.DstPort)
+		case *layers.ICMPv4, *layers.ICMPv6:
+			d.isICMP = true
+		}
+
+		d.headerLen += len(layer.LayerContents())
+
+		if layer == p.NetworkLayer() {
+			hasNetwork = true
+			networkEnd = d.headerLen
+		}
+		if layer == p.TransportLayer() || d.isICMP {
+			d.transport = layer
+			if typer, ok := layer.(nextLayerTyper); ok {
+				d.appType = typer.NextLayerType()
+			}
+			break
+		}
+	}
+
+	// Without the transport layer (e.g. fragments), the payload of the
+	// network layer is truncated.
+	if d.transport == nil {
+		d.headerLen = networkEnd
+	}
+
+	return d, hasNetwork
+}
+
+// matches returns true if the rule matches the packet.
+func (rule *TruncateRule) matches(d *decodedPacket) bool {
+	return matchProtocol(rule.Protocol, rule.Ports, d)
+}
+
+// matchProtocol returns true if the packet is of the protocol (one of
+// Truncate{Any,TCP,UDP,ICMP,DNS,TLS}) and has one of the ports as its source
+// or destination port (any port if empty).
+func matchProtocol(protocol string, ports []uint, d *decodedPacket) bool {
+	var ok bool
+
+	switch protocol {
+	case TruncateAny:
+		ok = true
+	case TruncateTCP:
+		_, ok = d.transport.(*layers.TCP)
+	case TruncateUDP:
+		_, ok = d.transport.(*layers.UDP)
+	case TruncateICMP:
+		ok = d.isICMP
+	case TruncateDNS:
+		ok = d.appType == layers.LayerTypeDNS
+	case TruncateTLS:
+		ok = d.appType == layers.LayerTypeTLS
+	}
+
+	if !ok || len(ports) == 0 {
+		return ok
+	}
+
+	for _, port := range ports {
+		if port == d.srcPort || port == d.dstPort {
+			return true
+		}
+	}
+	return false
+}
+
+// Truncate returns the data and CaptureInfo of the packet truncated by the
+// first matching rule. Length of CaptureInfo (the original length) is kept.
+// Packets without network layers are never truncated.
+func (t *packetTruncater) Truncate(capinfo gopacket.CaptureInfo, data []byte, linkType layers.LinkType) (gopacket.CaptureInfo, []byte) {
+	d, ok := decodeForTruncation(data, linkType)
+	if !ok {
+		return capinfo, data
+	}
+
+	for i := range t.rules {
+		rule := &t.rules[i]
+		if !rule.matches(d) {
+			continue
+		}
+		if rule.MaxPayload < 0 {
+			return capinfo, data
+		}
+
+		if length := d.headerLen + rule.MaxPayload; length < len(data) {
+			data = data[:length]
+			capinfo.CaptureLength = length
+		}
+		return capinfo, data
+	}
+
+	return capinfo, data
+}
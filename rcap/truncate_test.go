@@ -0,0 +1,95 @@
+package rcap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// makeUDPPacket returns an Ethernet frame of a UDP packet with the payload.
+func makeUDPPacket(t *testing.T, srcPort int, dstPort int, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{192, 0, 2, 1},
+		DstIP:    net.IP{198, 51, 100, 1},
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("failed to make packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPacketTruncaterTruncate(t *testing.T) {
+	const (
+		ethIPTCPLen = 14 + 20 + 20 // Headers of makeTCPPacket.
+		ethIPUDPLen = 14 + 20 + 8
+	)
+
+	c := makeConfig()
+	if tr := newPacketTruncater(&c.Rcap); tr != nil {
+		t.Errorf("nil is expected, but got '%v'.", tr)
+	}
+
+	c.Rcap.Truncate = []TruncateRule{
+		{Protocol: TruncateDNS, MaxPayload: -1},
+		{Protocol: TruncateTLS, MaxPayload: 0},
+		{Protocol: TruncateTCP, Ports: []uint{8080}, MaxPayload: 1},
+		{Protocol: TruncateTCP, MaxPayload: 2},
+		{Protocol: TruncateUDP, MaxPayload: 3},
+	}
+	tr := newPacketTruncater(&c.Rcap)
+
+	payload := make([]byte, 100)
+
+	cases := []struct {
+		name     string
+		data     []byte
+		expected int
+	}{
+		{"dns", makeUDPPacket(t, 12345, 53, payload), ethIPUDPLen + 100},
+		{"tls", makeTCPPacket(t, "192.0.2.1", 443, "198.51.100.1", 12345), ethIPTCPLen},
+		{"tcp/8080", makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 8080), ethIPTCPLen + 1},
+		{"tcp", makeTCPPacket(t, "192.0.2.1", 12345, "198.51.100.1", 80), ethIPTCPLen + 2},
+		{"udp", makeUDPPacket(t, 12345, 12346, payload), ethIPUDPLen + 3},
+		{"not ip", []byte("not a packet"), len("not a packet")},
+	}
+
+	for _, c := range cases {
+		capinfo := gopacket.CaptureInfo{CaptureLength: len(c.data), Length: len(c.data) + 10}
+
+		gotInfo, gotData := tr.Truncate(capinfo, c.data, layers.LinkTypeEthernet)
+		if len(gotData) != c.expected || gotInfo.CaptureLength != c.expected {
+			t.Errorf("'%v' is expected, but got '%v' (CaptureLength: %v) (%v).", c.expected, len(gotData), gotInfo.CaptureLength, c.name)
+		}
+		if gotInfo.Length != capinfo.Length {
+			t.Errorf("'%v' is expected, but got '%v' (%v).", capinfo.Length, gotInfo.Length, c.name)
+		}
+	}
+}
+
+func TestPacketTruncaterNoMatch(t *testing.T) {
+	c := makeConfig()
+	c.Rcap.Truncate = []TruncateRule{{Protocol: TruncateICMP, MaxPayload: 0}}
+	tr := newPacketTruncater(&c.Rcap)
+
+	data := makeUDPPacket(t, 12345, 12346, make([]byte, 100))
+	capinfo := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+
+	if _, got := tr.Truncate(capinfo, data, layers.LinkTypeEthernet); len(got) != len(data) {
+		t.Errorf("'%v' is expected, but got '%v'.", len(data), len(got))
+	}
+}
@@ -1,6 +1,7 @@
 package rcap
 
 import (
+	"io"
 	"math/rand"
 	"os"
 	"time"
@@ -11,7 +12,16 @@ var (
 )
 
 func init() {
-	randGen = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randGen = newRand(0)
+}
+
+// newRand returns a pseudo-random number generator with the seed. If the seed
+// is 0, the current time is used as the seed.
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
 }
 
 // Random returns a pseudo-random number in [0.0, 1.0).
@@ -27,3 +37,38 @@ func FileExists(filename string) bool {
 		return false
 	}
 }
+
+// fileSize returns the size of the given file, or def if it cannot be stat.
+func fileSize(filename string, def int64) int64 {
+	if info, err := os.Stat(filename); err == nil {
+		return info.Size()
+	}
+	return def
+}
+
+// writeFileAtomic writes the file with write through a temporary file in the
+// same directory, which is synced and renamed to the file on success. So the
+// file is never seen partially written (e.g. by a crash or other programs).
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	temp := filename + ".tmp"
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(temp, filename)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
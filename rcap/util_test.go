@@ -1,6 +1,10 @@
 package rcap
 
 import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -24,3 +28,40 @@ func TestFileExists(t *testing.T) {
 		t.Error("'' must be not found, but found.")
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+
+	err := writeFileAtomic(filename, func(w io.Writer) error {
+		// The file does not exist until it is written out.
+		if FileExists(filename) {
+			t.Errorf("'%v' is expected not to exist.", filename)
+		}
+		_, err := io.WriteString(w, "data")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "data" {
+		t.Errorf("'data' is expected, but got '%v'.", string(data))
+	}
+	if FileExists(filename + ".tmp") {
+		t.Errorf("'%v' is expected to be removed.", filename+".tmp")
+	}
+
+	// The file is kept if writing fails.
+	err = writeFileAtomic(filename, func(w io.Writer) error {
+		io.WriteString(w, "broken")
+		return errors.New("error")
+	})
+	if err == nil {
+		t.Error("err is expected, but got 'nil'.")
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "data" {
+		t.Errorf("'data' is expected, but got '%v'.", string(data))
+	}
+	if FileExists(filename + ".tmp") {
+		t.Errorf("'%v' is expected to be removed.", filename+".tmp")
+	}
+}
@@ -1,37 +1,104 @@
 package rcap
 
 import (
-	"log"
+	"bufio"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/jehiah/go-strftime"
 )
 
+const (
+	// DeviceToken is replaced with the device name in FileFmt. If FileFmt
+	// contains this token, packets are written to a file per device.
+	DeviceToken = "%i"
+
+	// FsyncPolicyNever leaves syncing files to the OS.
+	FsyncPolicyNever = "never"
+	// FsyncPolicyRotate syncs files when they are closed (e.g. at rotation).
+	FsyncPolicyRotate = "rotate"
+	// FsyncPolicyInterval syncs files every FsyncInterval and when they are
+	// closed.
+	FsyncPolicyInterval = "interval"
+)
+
 // Writer writes packet data to files which are rotated every interval.
 type Writer struct {
 	config      *Config
+	fileFmt     string
 	file        *os.File
-	writer      *pcapgo.Writer
-	linkType    layers.LinkType
+	finalName   string        // Name of the file after it is closed (see PartFiles).
+	buffer      *bufio.Writer // nil if WriteBufferSize is 0.
+	compressor  io.WriteCloser
+	writer      packetWriter
+	interfaces  []captureInterface
 	lastRotTime int64
+	fileTime    int64 // Timestamp used for the filename of the current file.
 	numPackets  uint
+	numBytes    int64
+	appended    int64 // Size of the existing file which packets are appended to.
+
+	lastFlushTime time.Time // System time when the buffers were flushed.
+	lastSyncTime  time.Time // System time when the file was synced.
+
+	retentionRunning int32                     // Set while the retention policy is applied.
+	onRotate         func(*Writer)             // Called before the file is rotated (if set).
+	statsBase        map[*Reader]statsSnapshot // Counters of the readers at the last report.
+
+	firstPacketTime time.Time        // Timestamp of the first packet in the file.
+	lastPacketTime  time.Time        // Timestamp of the last packet in the file.
+	onClose         func(closedFile) // Called after the file is closed (if set).
+
+	ring    *ringBuffer    // nil if the ring buffer is disabled.
+	trigger *triggerBuffer // nil if the trigger mode is disabled.
 }
 
-// NewWriter returns a new instance of Writer.
+// NewWriter returns a new instance of Writer which writes packets captured on
+// the first device of the configuration.
 func NewWriter(c *Config, linkType layers.LinkType) (*Writer, error) {
+	device := c.Rcap.CaptureDevices()[0]
+	return newWriter(c, []captureInterface{{device: device, linkType: linkType}})
+}
+
+// newWriter returns a new instance of Writer which writes packets captured on
+// the given interfaces. The InterfaceIndex of packets written by the Writer
+// must be the index of interfaces. If there is only one interface, DeviceToken
+// in FileFmt is replaced with its device name.
+func newWriter(c *Config, interfaces []captureInterface) (*Writer, error) {
+	fileFmt := c.Rcap.FileFmt
+	if len(interfaces) == 1 {
+		name := strings.ReplaceAll(interfaces[0].device.Name, string(filepath.Separator), "_")
+		fileFmt = strings.ReplaceAll(fileFmt, DeviceToken, name)
+	}
+
+	if err := checkInterfaces(c.Rcap.OutputFormat, interfaces); err != nil {
+		return nil, err
+	}
+
 	w := &Writer{
 		config:      c,
-		linkType:    linkType,
+		fileFmt:     fileFmt,
+		interfaces:  interfaces,
 		lastRotTime: 0,
 		numPackets:  0,
 	}
 
+	if c.Rcap.RingFiles > 0 {
+		w.ring = newRingBuffer(fileFmt, c.Rcap.RingFiles)
+	}
+	if c.Rcap.Trigger {
+		w.trigger = newTriggerBuffer(&c.Rcap)
+	}
+
+	recoverPartFiles(&c.Rcap, fileFmt)
+
 	return w, nil
 }
 
@@ -41,6 +108,34 @@ func (w *Writer) NumPackets() uint {
 	return w.numPackets
 }
 
+// currentFileName returns the name of the current file, or an empty string if
+// no file is open.
+func (w *Writer) currentFileName() string {
+	if w.file == nil {
+		return ""
+	}
+	return w.file.Name()
+}
+
+// shouldSplit returns true if a packet record of the given size cannot be
+// written to the current file because of MaxFileBytes or MaxFilePackets. The
+// size of the file is counted before compression, including the file header.
+// At least one packet is written to a new file even if it exceeds the limit.
+func (w *Writer) shouldSplit(size int64) bool {
+	c := &w.config.Rcap
+
+	if w.numPackets == 0 && w.numBytes == 0 {
+		return false
+	}
+	if c.MaxFilePackets > 0 && w.numPackets >= c.MaxFilePackets {
+		return true
+	}
+	if c.MaxFileBytes > 0 && w.numBytes+size > c.MaxFileBytes {
+		return true
+	}
+	return false
+}
+
 // shoudRotate returns true if the file should be rotated, otherwise false.
 func (w *Writer) shouldRotate(ts int64) bool {
 	c := &w.config.Rcap
@@ -85,11 +180,14 @@ func (w *Writer) PrintRotLog() {
 		nextTime = nextTime.In(c.Location)
 	}
 
-	log.Printf("rotation time: last=%v, next=%v", currentTime, nextTime)
+	slog.Info("rotation time", "last", currentTime, "next", nextTime)
 }
 
 // newFileName returns a filename of PCAP file based on the given timestamp.
-func makeFileName(format string, ts int64, loc *time.Location, doAppend bool) string {
+// If doAppend is false and the file exists, an alternative filename with a
+// suffix is returned. The file is also regarded as existing if the filename
+// with any of the given extensions (e.g. ".gz") exists.
+func makeFileName(format string, ts int64, loc *time.Location, doAppend bool, extensions ...string) string {
 	locTime := time.Unix(ts, 0).In(loc)
 	filename := strftime.Format(format, locTime)
 
@@ -97,59 +195,194 @@ func makeFileName(format string, ts int64, loc *time.Location, doAppend bool) st
 		return filename
 	}
 
-	if !FileExists(filename) {
+	exists := func(filename string) bool {
+		for _, ext := range extensions {
+			if FileExists(filename + ext) {
+				return true
+			}
+		}
+		return FileExists(filename)
+	}
+
+	if !exists(filename) {
 		return filename
 	}
 
 	// If file exists, find alternative filename.
-	extension := filepath.Ext(filename)
-	baseFilename := filename[:len(filename)-len(extension)]
+	baseFilename := filename
 
-	for i := 1; FileExists(filename); i++ {
-		log.Println("file already exists: ", filename)
-		filename = baseFilename + "-" + strconv.Itoa(i) + extension
+	for i := 1; exists(filename); i++ {
+		slog.Info("file already exists", "file", filename)
+		filename = suffixedFileName(baseFilename, i)
 	}
 
 	return filename
 }
 
+// suffixedFileName returns the filename with the suffix (e.g. some-file-1.pcap).
+func suffixedFileName(filename string, i int) string {
+	extension := filepath.Ext(filename)
+	return filename[:len(filename)-len(extension)] + "-" + strconv.Itoa(i) + extension
+}
+
 func (w *Writer) openWriter(ts int64) error {
+	return w.openWriterWithAppend(ts, w.config.Rcap.FileAppend)
+}
+
+// openWriterWithAppend opens a file for the timestamp. If doAppend is false,
+// an existing file is never appended and a new file with a suffix is made. In
+// the ring buffer mode, the file of the next slot is overwritten instead.
+func (w *Writer) openWriterWithAppend(ts int64, doAppend bool) error {
 	c := w.config.Rcap
 
-	fileName := makeFileName(c.FileFmt, ts, c.Location, c.FileAppend)
+	// Compressed files are never appended because the end of the compressed
+	// stream has been written. A new file with a suffix is made instead.
+	ext := compressionExt(c.Compression)
+	compressed := ext != ""
+
+	nanos := c.TimestampPrecision == TimestampPrecisionNano
+
+	var fileName string
+	if w.ring != nil {
+		var err error
+		// Manifests of the old files are also removed.
+		if fileName, err = w.ring.next(ext, ManifestSuffix, ext+ManifestSuffix); err != nil {
+			return err
+		}
+	} else {
+		fileName = makeFileName(w.fileFmt, ts, c.Location, doAppend && !compressed, ext)
+	}
+	if compressed && c.CompressionMode == CompressionModeStream {
+		fileName += ext
+	}
 	isNewFile := !FileExists(fileName)
 
+	// Check the existing file before appending packets to it.
+	if !isNewFile {
+		var err error
+		fileName, isNewFile, err = w.prepareAppend(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Make a directory for PCAP files.
 	dirName := filepath.Dir(fileName)
 	if err := os.MkdirAll(dirName, 0755); err != nil {
 		return err
 	}
 
+	// The file is written under the name in progress until it is closed. The
+	// existing file is moved to the name to append packets to it.
+	partName := partFileName(&c, fileName)
+	if partName != fileName && FileExists(fileName) {
+		if err := os.Rename(fileName, partName); err != nil {
+			return err
+		}
+	}
+
 	// Make a new file.
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(partName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("dump packets into a file: %v (append: %v)", fileName, !isNewFile)
+	// The size of the existing file counts toward MaxFileBytes.
+	var numBytes int64
+	if info, err := file.Stat(); err == nil {
+		numBytes = info.Size()
+	}
+
+	slog.Info("dump packets into a file", "file", fileName, "format", c.OutputFormat, "append", !isNewFile)
 
-	// Make a new writer.
-	writer := pcapgo.NewWriter(file)
-	if isNewFile {
-		writer.WriteFileHeader(uint32(c.SnapLen), w.linkType)
+	// Make a new writer. Packets are buffered so that each packet does not
+	// issue a write system call.
+	var output io.Writer = file
+	var buffer *bufio.Writer
+	var compressor io.WriteCloser
+
+	if c.WriteBufferSize > 0 {
+		buffer = bufio.NewWriterSize(file, c.WriteBufferSize)
+		output = buffer
 	}
 
+	if compressed && c.CompressionMode == CompressionModeStream {
+		compressor, err = newCompressor(output, c.Compression)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		output = compressor
+	}
+
+	// The file header (or the pcapng section) counts toward MaxFileBytes.
+	header := &countingWriter{w: output}
+	writer, err := newPacketWriter(header, isNewFile, c.OutputFormat, nanos, w.interfaces)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	numBytes += header.n
+
+	metrics.setCurrentFile(w, partName)
+
+	w.fileTime = ts
 	w.numPackets = 0
+	w.numBytes = numBytes
+	w.appended = 0
+	if !isNewFile {
+		w.appended = numBytes - header.n
+	}
+	w.firstPacketTime = time.Time{}
+	w.lastPacketTime = time.Time{}
+	w.lastFlushTime = time.Now()
+	w.lastSyncTime = w.lastFlushTime
 	w.file = file
+	w.finalName = fileName
+	w.buffer = buffer
+	w.compressor = compressor
 	w.writer = writer
 
 	return nil
 }
 
-// Update method updates internal timestamp and rotates the file.
+// rotate opens a new file at lastRotTime and applies the retention policy.
+func (w *Writer) rotate() error {
+	if err := w.openWriter(w.lastRotTime); err != nil {
+		return err
+	}
+
+	w.applyRetention()
+	return nil
+}
+
+// split closes the current file and opens a new file with a suffix for the
+// same timestamp, so the rotation interval is not changed.
+func (w *Writer) split() error {
+	slog.Info("split the file", "file", w.currentFileName(), "packets", w.numPackets, "bytes", w.numBytes)
+	if w.onRotate != nil {
+		w.onRotate(w)
+	}
+	w.Close()
+	metrics.addRotation()
+
+	if err := w.openWriterWithAppend(w.fileTime, false); err != nil {
+		return err
+	}
+
+	w.applyRetention()
+	return nil
+}
+
+// Update method updates internal timestamp and rotates the file. In the
+// trigger mode, files are not rotated but closed at the end of events.
 func (w *Writer) Update(ts int64) error {
 	c := &w.config.Rcap
 
+	if w.trigger != nil {
+		return w.updateTrigger(ts)
+	}
+
 	// Never rotate.
 	if c.Interval == 0 {
 		if w.file == nil {
@@ -169,40 +402,225 @@ func (w *Writer) Update(ts int64) error {
 		}
 		w.lastRotTime = rotTime
 		w.PrintRotLog()
-		return w.openWriter(w.lastRotTime)
+		return w.rotate()
 	}
 
 	// Do rotate.
 	if w.shouldRotate(ts) {
-		log.Printf("capture %v packets.", w.numPackets)
+		slog.Info("rotate the file", "file", w.currentFileName(), "packets", w.numPackets, "bytes", w.numBytes)
+		if w.onRotate != nil {
+			w.onRotate(w)
+		}
 		w.Close()
+		metrics.addRotation()
 		w.lastRotTime += c.Interval
 		w.PrintRotLog()
-		return w.openWriter(w.lastRotTime)
+		return w.rotate()
 	}
 
 	// Do nothing.
 	return nil
 }
 
-// WritePacket writes packet data to the file.
-// Update method must be called before WritePacket to make file.
+// WritePacket writes packet data to the file. If the file reaches
+// MaxFileBytes or MaxFilePackets, the packet is written to a new file.
+// Update method must be called before WritePacket to make file. In the
+// trigger mode, packets are kept in memory unless an event is in progress.
 func (w *Writer) WritePacket(capinfo gopacket.CaptureInfo, data []byte) error {
+	if w.trigger != nil && w.file == nil {
+		w.trigger.push(capinfo, data)
+		return nil
+	}
+
+	size := recordSize(w.config.Rcap.OutputFormat, len(data))
+	if w.shouldSplit(size) {
+		if err := w.split(); err != nil {
+			return err
+		}
+	}
+
+	// NOTE: The 'data' are copied to the buffer (or in the write system call
+	// if unbuffered), so they can be overwritten after this call.
+	if err := w.writer.WritePacket(capinfo, data); err != nil {
+		metrics.addWriteError()
+		return err
+	}
+
+	if w.numPackets == 0 {
+		w.firstPacketTime = capinfo.Timestamp
+	}
+	w.lastPacketTime = capinfo.Timestamp
+
 	w.numPackets += 1
+	w.numBytes += size
+	metrics.addPacketWritten(size)
 
-	// NOTE: WritePacket function calls write system call,
-	// so the 'data' are copied in the write system call.
-	return w.writer.WritePacket(capinfo, data)
+	return nil
 }
 
-// Close closes a file in a Writer instance.
+// Flush writes out the data buffered by the packet writer, the compressor and
+// the buffer of the file, so the file is readable up to the last packet.
+func (w *Writer) Flush() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.writer.Flush()
+	if f, ok := w.compressor.(interface{ Flush() error }); ok && err == nil {
+		err = f.Flush()
+	}
+	if w.buffer != nil && err == nil {
+		err = w.buffer.Flush()
+	}
+	if err != nil {
+		metrics.addWriteError()
+		return err
+	}
+
+	w.lastFlushTime = time.Now()
+	return nil
+}
+
+// Sync flushes the buffers and commits the file to the disk.
+func (w *Writer) Sync() error {
+	if w.file == nil {
+		return nil
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.lastSyncTime = w.lastFlushTime
+	return nil
+}
+
+// flushIfDue flushes the buffers every FlushInterval (or anyway if force is
+// true), and syncs the file every FsyncInterval if FsyncPolicy is "interval".
+func (w *Writer) flushIfDue(now time.Time, force bool) error {
+	c := &w.config.Rcap
+
+	if w.file == nil {
+		return nil
+	}
+
+	if c.FsyncPolicy == FsyncPolicyInterval && now.Sub(w.lastSyncTime) >= c.FsyncInterval {
+		return w.Sync()
+	}
+
+	if force || (c.FlushInterval > 0 && now.Sub(w.lastFlushTime) >= c.FlushInterval) {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// closedFile returns the information of the current file passed to onClose.
+// If no packets are written, the start and end time are the time of the file.
+func (w *Writer) closedFile() closedFile {
+	c := &w.config.Rcap
+
+	f := closedFile{
+		name:        w.finalName,
+		start:       w.firstPacketTime,
+		end:         w.lastPacketTime,
+		numPackets:  w.numPackets,
+		numBytes:    w.numBytes,
+		appended:    w.appended,
+		windowStart: time.Unix(w.fileTime, 0),
+	}
+	if w.numPackets == 0 {
+		f.start = f.windowStart
+		f.end = f.start
+	}
+	if c.Interval > 0 && w.trigger == nil {
+		f.windowEnd = f.windowStart.Add(time.Duration(c.Interval) * time.Second)
+	}
+	return f
+}
+
+// Close closes a file in a Writer instance after flushing the buffers (and
+// syncing the file unless FsyncPolicy is "never"). If CompressionMode is
+// "rotate", the closed file is compressed in background. onClose is called
+// after the file is closed (and compressed).
 func (w *Writer) Close() error {
 	var err error
 
+	if w.writer != nil {
+		err = w.writer.Flush()
+	}
+
+	if w.compressor != nil {
+		if cerr := w.compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if w.buffer != nil {
+		if cerr := w.buffer.Flush(); err == nil {
+			err = cerr
+		}
+	}
+
 	if w.file != nil {
-		err = w.file.Close()
+		if w.config.Rcap.FsyncPolicy != FsyncPolicyNever {
+			if cerr := w.file.Sync(); err == nil {
+				err = cerr
+			}
+		}
+
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+
+		// The file is renamed even if the close fails, so that it is not
+		// regarded as in progress.
+		if cerr := finalizeFile(w.file.Name(), w.finalName); cerr != nil {
+			slog.Error("failed to rename the file in progress", "file", w.file.Name(), "error", cerr)
+			if err == nil {
+				err = cerr
+			}
+		}
+
+		closed := w.closedFile()
+		onClose := w.onClose
+
+		c := &w.config.Rcap
+		if compressionExt(c.Compression) != "" && c.CompressionMode == CompressionModeRotate {
+			compressFileInBackground(closed.name, c.Compression, func(compressed string) {
+				if onClose != nil {
+					closed.name = compressed
+					closed.numBytes = fileSize(compressed, closed.numBytes)
+					onClose(closed)
+				}
+			})
+		} else if onClose != nil {
+			closed.numBytes = fileSize(closed.name, closed.numBytes)
+			onClose(closed)
+		}
 	}
 
+	metrics.setCurrentFile(w, "")
+
 	w.file = nil
+	w.finalName = ""
+	w.buffer = nil
+	w.compressor = nil
+	w.writer = nil
 	return err
 }
+
+// countingWriter is an io.Writer which counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,12 +1,17 @@
 package rcap
 
 import (
+	"compress/gzip"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 )
 
 func TestNewWriter(t *testing.T) {
@@ -52,6 +57,33 @@ func TestWriterShouldRotate(t *testing.T) {
 	}
 }
 
+func TestWriterShouldSplit(t *testing.T) {
+	cases := []struct {
+		// in
+		config     RcapConfig
+		numPackets uint
+		numBytes   int64
+		size       int64
+		// out
+		split bool
+	}{
+		{RcapConfig{}, 100, 10000, 100, false},
+		{RcapConfig{MaxFilePackets: 10}, 9, 1000, 100, false},
+		{RcapConfig{MaxFilePackets: 10}, 10, 1000, 100, true},
+		{RcapConfig{MaxFileBytes: 1000}, 9, 900, 100, false},
+		{RcapConfig{MaxFileBytes: 1000}, 9, 901, 100, true},
+		{RcapConfig{MaxFileBytes: 1000}, 0, 0, 2000, false},  // New file.
+		{RcapConfig{MaxFileBytes: 1000}, 0, 1000, 100, true}, // Appended file.
+	}
+
+	for _, c := range cases {
+		w := &Writer{config: &Config{Rcap: c.config}, numPackets: c.numPackets, numBytes: c.numBytes}
+		if split := w.shouldSplit(c.size); split != c.split {
+			t.Errorf("'%v' is expected, but got '%v': %+v", c.split, split, c)
+		}
+	}
+}
+
 func TestCalcFirstRotTime(t *testing.T) {
 	// without UTCOffset
 	interval := int64(60)
@@ -240,9 +272,18 @@ func TestMakeFileName(t *testing.T) {
 		}
 	}
 
+	// file found with the extension, do not append
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "19700101000000.pcap.gz"), nil, 0644)
+	os.WriteFile(filepath.Join(tempDir, "19700101000000-1.pcap"), nil, 0644)
+	expected := filepath.Join(tempDir, "19700101000000-2.pcap")
+	if res := makeFileName(filepath.Join(tempDir, "%Y%m%d%H%M%S.pcap"), 0, loc, false, ".gz"); res != expected {
+		t.Errorf("'%v' is expected, but got '%v'.", expected, res)
+	}
+
 	// test location
 	loc, _ = time.LoadLocation("Asia/Tokyo")
-	expected := "19700101-090000.txt"
+	expected = "19700101-090000.txt"
 	if res := makeFileName("%Y%m%d-%H%M%S.txt", 0, loc, false); res != expected {
 		t.Errorf("'%v' is expected, but got '%v'.", expected, res)
 	}
@@ -548,3 +589,325 @@ func TestWriterClose(t *testing.T) {
 	w.Update(86400)
 	w.Close()
 }
+
+func TestWriterFlush(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test.pcap")
+	c.Rcap.Interval = 0
+	c.Rcap.FlushInterval = time.Minute
+	c.CheckAndFormat()
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	w.Update(86400)
+
+	data := []byte("data")
+	capinfo := gopacket.CaptureInfo{Timestamp: time.Unix(86400, 0), CaptureLength: len(data), Length: len(data)}
+	w.WritePacket(capinfo, data)
+
+	// The header and the packet are kept in the buffer.
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 0 {
+		t.Errorf("'0' is expected, but got '%v'.", size)
+	}
+
+	// Not flushed before FlushInterval passes.
+	if err := w.flushIfDue(time.Now(), false); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 0 {
+		t.Errorf("'0' is expected, but got '%v'.", size)
+	}
+
+	// 24 bytes of the header and 20 bytes of the packet.
+	if err := w.flushIfDue(time.Now().Add(time.Minute), false); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 44 {
+		t.Errorf("'44' is expected, but got '%v'.", size)
+	}
+
+	// Flushed anyway if forced (e.g. on signals).
+	w.WritePacket(capinfo, data)
+	if err := w.flushIfDue(time.Now(), true); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 64 {
+		t.Errorf("'64' is expected, but got '%v'.", size)
+	}
+
+	// Synced every FsyncInterval.
+	c.Rcap.FsyncPolicy = FsyncPolicyInterval
+	c.Rcap.FsyncInterval = time.Minute
+	w.WritePacket(capinfo, data)
+	if err := w.flushIfDue(time.Now().Add(time.Minute), false); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 84 || w.lastSyncTime != w.lastFlushTime {
+		t.Errorf("'84' is expected, but got '%v'.", size)
+	}
+
+	// The rest is written out at close.
+	w.WritePacket(capinfo, data)
+	if err := w.Close(); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+	if size := fileSize(c.Rcap.FileFmt, -1); size != 104 {
+		t.Errorf("'104' is expected, but got '%v'.", size)
+	}
+
+	// No-op without files.
+	if err := w.flushIfDue(time.Now(), true); err != nil {
+		t.Errorf("nil is expected, but got '%v'.", err)
+	}
+}
+
+func TestWriterWritePacketPcapNg(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test.pcapng")
+	c.Rcap.OutputFormat = FormatPcapNg
+	c.CheckAndFormat()
+
+	data := []byte("data")
+	metadata := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(86400, 0),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+
+	// Write a packet twice (the second one is appended as a new section).
+	for i := 0; i < 2; i++ {
+		w, _ := NewWriter(c, layers.LinkTypeEthernet)
+		w.Update(86400)
+		if err := w.WritePacket(metadata, data); err != nil {
+			t.Errorf("no error is expected, but got '%v'.", err)
+		}
+		w.Close()
+	}
+
+	f, _ := os.Open(filepath.Join(tempDir, "test.pcapng"))
+	defer f.Close()
+
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("nil is expected, but got '%v'.", err)
+	}
+
+	numPackets := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			break
+		}
+		numPackets++
+	}
+	if numPackets != 2 {
+		t.Errorf("2 packets are expected, but got %v packet(s).", numPackets)
+	}
+}
+
+func TestWriterCompressionStream(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test.pcap")
+	c.Rcap.Compression = CompressionGzip
+	c.CheckAndFormat()
+
+	data := []byte("data")
+	metadata := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(86400, 0),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+
+	// The second file is not appended to the first one, but made with a suffix.
+	for i := 0; i < 2; i++ {
+		w, _ := NewWriter(c, layers.LinkTypeEthernet)
+		w.Update(86400)
+		w.WritePacket(metadata, data)
+		w.Close()
+	}
+
+	for _, name := range []string{"test.pcap.gz", "test-1.pcap.gz"} {
+		f, err := os.Open(filepath.Join(tempDir, name))
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		defer f.Close()
+
+		gz, _ := gzip.NewReader(f)
+		r, err := pcapgo.NewReader(gz)
+		if err != nil {
+			t.Fatalf("nil is expected, but got '%v'.", err)
+		}
+		if _, _, err := r.ReadPacketData(); err != nil {
+			t.Errorf("nil is expected, but got '%v'.", err)
+		}
+	}
+}
+
+func TestWriterCompressionRotate(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Compression = CompressionZstd
+	c.Rcap.CompressionMode = CompressionModeRotate
+	c.CheckAndFormat()
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	for ts := int64(86400); ts < 86400+180; ts++ {
+		w.Update(ts)
+	}
+	w.Close()
+	backgroundJobs.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap.zst"))
+	if numFiles := len(files); numFiles != 3 {
+		t.Errorf("3 files are expected, but got %v file(s).", numFiles)
+	}
+	files, _ = filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	if numFiles := len(files); numFiles != 0 {
+		t.Errorf("0 files are expected, but got %v file(s).", numFiles)
+	}
+}
+
+func TestWriterOnClose(t *testing.T) {
+	tempDir := t.TempDir()
+	data := []byte("data")
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test-%Y%m%d-%H%M%S.pcap")
+	c.Rcap.Compression = CompressionGzip
+	c.Rcap.CompressionMode = CompressionModeRotate
+	c.CheckAndFormat()
+
+	var mu sync.Mutex
+	var closed []closedFile
+
+	w, _ := NewWriter(c, layers.LinkTypeEthernet)
+	w.onClose = func(f closedFile) {
+		mu.Lock()
+		closed = append(closed, f)
+		mu.Unlock()
+	}
+
+	w.Update(86400)
+	for _, sec := range []int64{86401, 86410} {
+		metadata := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(sec, 0),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		w.WritePacket(metadata, data)
+	}
+	w.Close()
+	backgroundJobs.Wait()
+
+	if len(closed) != 1 {
+		t.Fatalf("1 file is expected, but got %v file(s).", len(closed))
+	}
+
+	f := closed[0]
+	if !strings.HasSuffix(f.name, ".pcap.gz") {
+		t.Errorf("the compressed file is expected, but got '%v'.", f.name)
+	}
+	if f.start.Unix() != 86401 || f.end.Unix() != 86410 {
+		t.Errorf("'86401-86410' is expected, but got '%v-%v'.", f.start.Unix(), f.end.Unix())
+	}
+	if f.numPackets != 2 {
+		t.Errorf("'2' is expected, but got '%v'.", f.numPackets)
+	}
+	if size := fileSize(f.name, -1); f.numBytes != size {
+		t.Errorf("'%v' is expected, but got '%v'.", size, f.numBytes)
+	}
+}
+
+func TestWriterSplit(t *testing.T) {
+	data := []byte("data")
+	metadata := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(86400, 0),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+
+	cases := []struct {
+		// in
+		maxFileBytes   int64
+		maxFilePackets uint
+		interval       int64
+		// out
+		numFiles int
+	}{
+		{0, 0, 60, 2},
+		{0, 3, 60, 5},   // 3 + 3 + 3 + 1 packets, and a file of the next interval.
+		{0, 3, 0, 4},    // Never rotate.
+		{100, 0, 60, 5}, // 3 + 3 + 3 + 1 packets (24 bytes of the header and 20 bytes per packet), and a file of the next interval.
+		{104, 0, 60, 4}, // 4 + 4 + 2 packets, and a file of the next interval.
+		{0, 10, 60, 2},
+	}
+
+	for _, c := range cases {
+		tempDir := t.TempDir()
+
+		config := makeConfig()
+		config.Rcap.FileFmt = filepath.Join(tempDir, "test-%Y%m%d-%H%M00.pcap")
+		config.Rcap.Interval = c.interval
+		config.Rcap.MaxFileBytes = c.maxFileBytes
+		config.Rcap.MaxFilePackets = c.maxFilePackets
+		config.CheckAndFormat()
+
+		w, _ := NewWriter(config, layers.LinkTypeEthernet)
+		for i := 0; i < 10; i++ {
+			w.Update(86400)
+			if err := w.WritePacket(metadata, data); err != nil {
+				t.Errorf("no error is expected, but got '%v'.", err)
+			}
+		}
+		w.Update(86460)
+		w.Close()
+
+		files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+		if numFiles := len(files); numFiles != c.numFiles {
+			t.Errorf("%v files are expected, but got %v file(s): %+v", c.numFiles, numFiles, c)
+		}
+		for _, file := range files {
+			if size := fileSize(file, -1); c.maxFileBytes > 0 && size > c.maxFileBytes {
+				t.Errorf("'%v' bytes at most are expected, but got '%v': %v", c.maxFileBytes, size, file)
+			}
+		}
+	}
+}
+
+func TestWriterAppendWithDifferentPrecision(t *testing.T) {
+	tempDir := t.TempDir()
+
+	c := makeConfig()
+	c.Rcap.FileFmt = filepath.Join(tempDir, "test.pcap")
+	c.CheckAndFormat()
+
+	// Write a pcap file in microseconds, and append to it in nanoseconds.
+	for _, precision := range []string{TimestampPrecisionMicro, TimestampPrecisionNano, TimestampPrecisionNano} {
+		c.Rcap.TimestampPrecision = precision
+		w, _ := NewWriter(c, layers.LinkTypeEthernet)
+		w.Update(86400)
+		w.Close()
+	}
+
+	for filename, nanos := range map[string]bool{"test.pcap": false, "test-1.pcap": true} {
+		f, _ := os.Open(filepath.Join(tempDir, filename))
+		header, err := readPcapFileHeader(f)
+		f.Close()
+		if err != nil || header.nanos != nanos {
+			t.Errorf("'%v' is expected, but got '%+v' (err: %v): %v", nanos, header, err, filename)
+		}
+	}
+
+	// The file of the same precision is appended.
+	files, _ := filepath.Glob(filepath.Join(tempDir, "*.pcap"))
+	if numFiles := len(files); numFiles != 2 {
+		t.Errorf("2 files are expected, but got %v file(s).", numFiles)
+	}
+}